@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jiphex/govealert/mauve"
+	"github.com/jiphex/govealert/mauvetest"
+)
+
+/*
+A stand-in for a real Mauve server, for trying out govealert (or anything
+else using the mauve package) without a Mauve install. It listens for
+AlertUpdates over UDP and keeps track of what's raised, which can be seen
+by fetching / from the -http address, or printed every -dump interval.
+*/
+func main() {
+	listen := flag.String("listen", "127.0.0.1:32741", "UDP address to listen for AlertUpdates on")
+	httpAddr := flag.String("http", "", "Address to serve a text dump of the alert table on (disabled if empty)")
+	dump := flag.Duration("dump", 0, "How often to print the alert table to stdout (disabled if zero)")
+	secretFile := flag.String("secret-file", "", "File containing a shared secret, updates not signed with it are dropped")
+	flag.Parse()
+
+	var secret []byte
+	if *secretFile != "" {
+		var err error
+		if secret, err = mauve.ReadSecretFile(*secretFile); err != nil {
+			log.Fatalf("Failed to read secret: %s", err)
+		}
+	}
+	srv, err := mauvetest.NewSignedServer(*listen, secret)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %s", *listen, err)
+	}
+	log.Printf("Listening for AlertUpdates on %s", srv.Addr())
+	if *httpAddr != "" {
+		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			srv.Dump(w)
+		})
+		go func() {
+			log.Fatal(http.ListenAndServe(*httpAddr, nil))
+		}()
+	}
+	if *dump > 0 {
+		for range time.Tick(*dump) {
+			srv.Dump(os.Stdout)
+		}
+	}
+	select {}
+}
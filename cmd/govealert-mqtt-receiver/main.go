@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	mqtt "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+	"github.com/jiphex/govealert/mauve"
+)
+
+func mqttDisconnect(client *mqtt.Client, reason error) {
+	log.Fatalf("Lost MQTT Connection because: %s", reason)
+}
+
+// A message received from the broker, in whichever version of MQTT.
+type message struct {
+	Topic    string
+	Payload  []byte
+	Retained bool
+	// From the MQTT 5 properties, so empty for MQTT 3
+	ContentType string
+	Source      string
+	Published   int64
+}
+
+// Publishes something retained, at QoS 1, such as the receiver's heartbeat.
+type publisher func(topic string, payload []byte) error
+
+// A manifest, published for a replace, is turned into clears for whichever
+// alerts from its source have gone. Retained manifests (from before we
+// subscribed) are only taken as what the source has now, apart from
+// clearing any retained alerts left over from before the replace.
+func convertManifest(tracker *mauve.ManifestTracker, source string, m *message, out chan<- *mauve.AlertUpdate) {
+	manifest, err := mauve.ParseManifest(m.Payload)
+	if err != nil {
+		log.Printf("Skipping bad manifest on %s: %s", m.Topic, err)
+		return
+	}
+	if manifest.Source != source {
+		log.Printf("Manifest on %s says it's from %s, using the topic's source", m.Topic, manifest.Source)
+		manifest.Source = source
+	}
+	var clears []*mauve.Alert
+	if m.Retained {
+		clears = tracker.Baseline(manifest)
+	} else {
+		clears = tracker.Replace(manifest)
+	}
+	if len(clears) == 0 {
+		return
+	}
+	log.Printf("Clearing %d alerts from %s no longer in its manifest", len(clears), source)
+	out <- mauve.CreateUpdate(source, false, clears...)
+}
+
+// Retained alerts are the last state published for each alert, which with
+// skipRetained are taken as having been passed on already.
+func convertStreaming(topics *mauve.TopicScheme, skipRetained bool, inc <-chan *message, out chan<- *mauve.AlertUpdate) {
+	tracker := mauve.NewManifestTracker()
+	for m := range inc {
+		if source, err := topics.ParseManifestTopic(m.Topic); err == nil {
+			convertManifest(tracker, source, m, out)
+			continue
+		}
+		if len(m.Payload) == 0 {
+			// Someone deleting a retained alert
+			continue
+		}
+		// Either JSON or protobuf, see README-MQTT.md
+		claimed, alert, err := mauve.UnmarshalMQTTAlertAs(m.ContentType, m.Payload)
+		if err != nil {
+			log.Printf("Skipping packet on %s that failed to unmarshal: %s", m.Topic, err)
+			continue
+		}
+		source, _, _, err := topics.Parse(m.Topic)
+		if err != nil {
+			log.Printf("Skipping packet with bad topic: %s", err)
+			continue
+		}
+		if claimed == "" {
+			claimed = m.Source
+		}
+		if claimed != "" && claimed != source {
+			log.Printf("Alert on %s says it's from %s, using the topic's source", m.Topic, claimed)
+		}
+		published := m.Published
+		if published == 0 {
+			published = mauve.JSONPublished(m.Payload)
+		}
+		if !m.Retained {
+			tracker.Seen(source, alert.GetId())
+		} else if !tracker.SeenRetained(source, alert.GetId(), published) {
+			// Its last state is still retained, but a replace has swept it
+			log.Printf("Clearing retained alert on %s which isn't in its source's manifest", m.Topic)
+			out <- mauve.CreateUpdate(source, false, mauve.NewAlert(alert.GetId(), mauve.WithSubject(alert.GetSubject()), mauve.ClearAfter(0)))
+			continue
+		}
+		if skipRetained && m.Retained {
+			log.Printf("Skipping retained alert on %s", m.Topic)
+			continue
+		}
+		up := mauve.CreateUpdate(source, false, alert)
+		log.Printf("Got %v", alert)
+		out <- up
+	}
+}
+
+func sendToMauve(client *mauve.ProtobufClient, queue <-chan *mauve.AlertUpdate) {
+	// Any AlertUpdate that gets written to the channel will get sent
+	// to the Mauve server(s)
+	for up := range queue {
+		if err := client.Send(context.Background(), up); err != nil {
+			log.Printf("Failed to send message: %s", err)
+		} else {
+			log.Printf("Sent %s@%s/%s to Mauve.", up.Alert[0].GetId(), up.GetSource(), up.Alert[0].GetSubject())
+		}
+	}
+}
+
+// How to connect to the broker, beyond its URL.
+type mqttAuth struct {
+	TLSConfig *tls.Config
+	Username  string
+	Password  string
+	// The receiver's session is kept between connections, so its client ID
+	// is this followed by the hostname, rather than anything random.
+	ClientIDPrefix string
+	ConnectTimeout time.Duration
+}
+
+func dialMQTT(broker string, topics *mauve.TopicScheme, qos byte, auth mqttAuth) (publisher, chan *message) {
+	incomingMessages := make(chan *message)
+	hostname, _ := os.Hostname()
+	clientId := auth.ClientIDPrefix + hostname
+	mqttOpts := mqtt.NewClientOptions().AddBroker(broker).SetClientID(clientId).SetCleanSession(false).SetConnectionLostHandler(mqttDisconnect)
+	mqttOpts.SetConnectTimeout(auth.ConnectTimeout)
+	if auth.TLSConfig != nil {
+		mqttOpts.SetTLSConfig(auth.TLSConfig)
+	}
+	if auth.Username != "" {
+		mqttOpts.SetUsername(auth.Username)
+	}
+	if auth.Password != "" {
+		mqttOpts.SetPassword(auth.Password)
+	}
+	mqttOpts.SetBinaryWill(mqttHeartbeatTopic(topics.Base), mqttStatusPacket(false), byte(1), true)
+	client := mqtt.NewClient(mqttOpts)
+	if tok := client.Connect(); !tok.WaitTimeout(auth.ConnectTimeout) {
+		log.Fatalf("Timed out connecting to MQTT Broker: %s", broker)
+	} else if tok.Error() != nil {
+		log.Fatalf("Failed to connect to MQTT Broker: %s - %s", broker, tok.Error())
+	}
+	log.Printf("Connected to Broker")
+	// Alerts, and the manifests sent for replaces
+	for _, filter := range []string{topics.Filter(), topics.ManifestFilter()} {
+		tok := client.Subscribe(filter, qos, func(client *mqtt.Client, msg mqtt.Message) {
+			log.Printf("Packet on %s", msg.Topic())
+			incomingMessages <- &message{Topic: msg.Topic(), Payload: msg.Payload(), Retained: msg.Retained()}
+		})
+		if tok.Wait() && tok.Error() != nil {
+			log.Fatalf("Failed to subscribe to %s: %s", filter, tok.Error())
+		}
+	}
+	publish := func(topic string, payload []byte) error {
+		tok := client.Publish(topic, byte(1), true, payload)
+		tok.Wait()
+		return tok.Error()
+	}
+	return publish, incomingMessages
+}
+
+// The heartbeat topic as described in README-MQTT.md
+func mqttHeartbeatTopic(baseTopic string) string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s/%s/$heartbeat", baseTopic, hostname)
+}
+
+func mqttStatusPacket(running bool) []byte {
+	hostname, _ := os.Hostname()
+	now := time.Now().Unix()
+	status := map[string]string{
+		"hostname": hostname,
+		"now":      strconv.FormatInt(now, 10),
+		"running":  strconv.FormatBool(running),
+	}
+	pkt, _ := json.Marshal(status)
+	return pkt
+}
+
+func mqttHeartbeat(topicBase string, interval time.Duration, publish publisher) {
+	publishTopic := mqttHeartbeatTopic(topicBase)
+	for {
+		log.Printf("Publishing heartbeat to %s", publishTopic)
+		if err := publish(publishTopic, mqttStatusPacket(true)); err != nil {
+			log.Printf("Failed to publish heartbeat: %s", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+/*
+So what we want to do here is to sit and listen on the MQTT channel
+provided and receive MQTTMessages containing Alerts.
+
+Every Alert needs to be wrapped into an AlertUpdate, and then passed to
+Mauve.
+*/
+func main() {
+	mauvealert := flag.String("mauve", "alert.bytemark.co.uk:32741", "Mauve server to send alerts to, either host:port or a domain to look up the _mauvealert._udp SRV records of")
+	srvPolicy := flag.String("srv-policy", "all", "Which of the SRV records to send to: all, priority or weighted")
+	mauveHosts := flag.String("mauve-hosts-file", "", "File listing the Mauve servers of domains to use instead of DNS, see mauve.StaticResolver")
+	dnsServer := flag.String("dns-server", "", "DNS server (host[:port]) to look up Mauve servers with instead of the system's")
+	mqttBroker := flag.String("mqtt-broker", "tcp://localhost:1883", "The MQTT Broker to connect to")
+	mqttTopic := flag.String("mqtt-base", "govealert", "Base topic for MQTT transport packets")
+	mqttTopicTemplate := flag.String("mqtt-topics", mauve.DefaultTopicTemplate, "Layout of alert topics: v1 ({base}/{subject}/{source}/{id}), legacy ({base}/{source}/{subject}/{id}) or a template of your own")
+	mqttCA := flag.String("mqtt-ca", "", "PEM bundle of CAs to trust for an ssl:// or tls:// MQTT broker, instead of the system's")
+	mqttCert := flag.String("mqtt-cert", "", "PEM client certificate to present to the MQTT broker")
+	mqttKey := flag.String("mqtt-key", "", "PEM key for -mqtt-cert")
+	mqttServerName := flag.String("mqtt-server-name", "", "Name to check the MQTT broker's certificate against, if not the host in -mqtt-broker")
+	mqttTimeout := flag.Duration("mqtt-connect-timeout", mauve.DefaultMQTTConnectTimeout, "How long to wait to connect to the MQTT broker")
+	mqttVersion := flag.Int("mqtt-version", 3, "Version of MQTT to speak to the broker: 3 or 5 (if built with the mqtt5 tag)")
+	mqttQoS := flag.Uint("mqtt-qos", 1, "QoS to subscribe with: 0, 1 or 2")
+	skipRetained := flag.Bool("skip-retained", false, "Don't pass on retained alerts (e.g. from -mqtt-retain publishers), only ones published while running")
+	mqttUsername := flag.String("mqtt-username", "", "Username for the MQTT broker")
+	mqttPasswordFile := flag.String("mqtt-password-file", "", "File containing the password (or token) for the MQTT broker, otherwise it's taken from $"+mauve.MQTTPasswordEnv)
+	mqttClientIDPrefix := flag.String("mqtt-client-id-prefix", "govealert-mqtt-receiver-", "Start of the MQTT client ID, which is followed by the hostname")
+	heartbeat := flag.Duration("heartbeat", time.Duration(60)*time.Second, "How often to publish the receiver's $heartbeat status")
+	secretFile := flag.String("secret-file", "", "File containing a shared secret used to sign updates sent to Mauve")
+	flag.Parse()
+
+	policy, err := mauve.ParseSRVPolicy(*srvPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := []mauve.ProtobufOption{mauve.WithSRVPolicy(policy)}
+	resolver, err := mauve.OpenResolver(*mauveHosts, *dnsServer)
+	if err != nil {
+		log.Fatalf("Failed to set up resolver: %s", err)
+	}
+	if resolver != nil {
+		opts = append(opts, mauve.WithResolver(resolver))
+	}
+	// The source is taken from each update, so doesn't matter here
+	pbc, err := mauve.CreateProtobufClient("", *mauvealert, opts...)
+	if err != nil {
+		log.Fatalf("Cannot resolve mauvealert server: %s", err)
+	}
+	if *secretFile != "" {
+		if pbc.Secret, err = mauve.ReadSecretFile(*secretFile); err != nil {
+			log.Fatalf("Failed to read secret: %s", err)
+		}
+	}
+
+	msend := make(chan *mauve.AlertUpdate, 50) // the channel we'll dump AlertUpdate packets destined for Mauve into
+	go sendToMauve(pbc, msend)                 // this goroutine will send any packets on the msend channel into mauve
+
+	auth := mqttAuth{Username: *mqttUsername, ClientIDPrefix: *mqttClientIDPrefix, ConnectTimeout: *mqttTimeout}
+	if *mqttCA != "" || *mqttCert != "" || *mqttKey != "" || *mqttServerName != "" {
+		if auth.TLSConfig, err = mauve.NewTLSConfig(*mqttCA, *mqttCert, *mqttKey, *mqttServerName); err != nil {
+			log.Fatal(err)
+		}
+		if err := mauve.CheckTLSBroker(*mqttBroker, auth.TLSConfig); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if auth.Password, err = mauve.ReadMQTTPassword(*mqttPasswordFile); err != nil {
+		log.Fatal(err)
+	}
+	topics, err := mauve.NewTopicScheme(*mqttTopic, *mqttTopicTemplate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *mqttQoS > 2 {
+		log.Fatalf("Bad -mqtt-qos %d, should be 0, 1 or 2", *mqttQoS)
+	}
+	var publish publisher
+	var incomingAlerts chan *message
+	switch *mqttVersion {
+	case 3:
+		publish, incomingAlerts = dialMQTT(*mqttBroker, topics, byte(*mqttQoS), auth)
+	case 5:
+		publish, incomingAlerts = dialMQTT5(*mqttBroker, topics, byte(*mqttQoS), auth)
+	default:
+		log.Fatalf("Unknown -mqtt-version %d, should be 3 or 5", *mqttVersion)
+	}
+	go mqttHeartbeat(*mqttTopic, *heartbeat, publish)
+
+	convertedAlerts := make(chan *mauve.AlertUpdate)
+	go convertStreaming(topics, *skipRetained, incomingAlerts, convertedAlerts)
+
+	for inc := range convertedAlerts {
+		log.Printf("Passing on alertUpdate as: %v", inc)
+		msend <- inc
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/jiphex/govealert/mauve"
+)
+
+var testTopics, _ = mauve.NewTopicScheme("govealert", "v1")
+
+// A raised alert from web1, as published at the given time.
+func alertMessage(id string, published int64, retained bool) *message {
+	al := mauve.NewAlert(id, mauve.WithSubject("db1"), mauve.RaiseAfter(0))
+	payload, _ := json.Marshal(&mauve.JSONAlert{Id: id, Source: "web1", Subject: "db1", RaiseTime: al.GetRaiseTime(), Published: published})
+	return &message{Topic: testTopics.Topic("web1", al), Payload: payload, Retained: retained}
+}
+
+// web1's manifest listing ids, as published at the given time.
+func manifestMessage(published int64, retained bool, ids ...string) *message {
+	payload, _ := json.Marshal(&mauve.Manifest{Source: "web1", Ids: ids, Published: published})
+	return &message{Topic: testTopics.ManifestTopic("web1"), Payload: payload, Retained: retained}
+}
+
+// Run the messages through convertStreaming, describing each alert passed
+// on to Mauve as "raise source/id" or "clear source/id".
+func convertAll(skipRetained bool, msgs ...*message) []string {
+	inc := make(chan *message, len(msgs))
+	for _, m := range msgs {
+		inc <- m
+	}
+	close(inc)
+	out := make(chan *mauve.AlertUpdate, 100)
+	convertStreaming(testTopics, skipRetained, inc, out)
+	close(out)
+	var got []string
+	for up := range out {
+		for _, al := range up.Alert {
+			action := "raise"
+			if al.GetClearTime() != 0 && al.GetClearTime() >= al.GetRaiseTime() {
+				action = "clear"
+			}
+			got = append(got, fmt.Sprintf("%s %s/%s", action, up.GetSource(), al.GetId()))
+		}
+	}
+	return got
+}
+
+func TestConvertStreaming(t *testing.T) {
+	testCases := []struct {
+		name         string
+		skipRetained bool
+		msgs         []*message
+		want         []string
+	}{
+		{"retained manifest after retained alerts", false, []*message{
+			alertMessage("a", 1000, true),
+			alertMessage("b", 1000, true),
+			alertMessage("c", 3000, true),
+			manifestMessage(2000, true, "b"),
+		}, []string{"raise web1/a", "raise web1/b", "raise web1/c", "clear web1/a"}},
+		{"retained manifest before retained alerts", false, []*message{
+			manifestMessage(2000, true, "b"),
+			alertMessage("a", 1000, true),
+			alertMessage("b", 1000, true),
+			alertMessage("c", 3000, true),
+		}, []string{"clear web1/a", "raise web1/b", "raise web1/c"}},
+		{"retained alerts that don't say when they were published", false, []*message{
+			manifestMessage(2000, true, "b"),
+			alertMessage("a", 0, true),
+			alertMessage("b", 0, true),
+		}, []string{"clear web1/a", "raise web1/b"}},
+		{"skipping retained alerts still clears swept ones", true, []*message{
+			alertMessage("a", 1000, true),
+			alertMessage("b", 1000, true),
+			manifestMessage(2000, true, "b"),
+			alertMessage("c", 1000, true),
+		}, []string{"clear web1/a", "clear web1/c"}},
+		{"live replace", false, []*message{
+			alertMessage("a", 1000, false),
+			alertMessage("b", 1000, false),
+			manifestMessage(2000, false, "b"),
+			alertMessage("c", 3000, false),
+		}, []string{"raise web1/a", "raise web1/b", "clear web1/a", "raise web1/c"}},
+		{"live replace after retained alerts", false, []*message{
+			manifestMessage(2000, true, "a", "b"),
+			alertMessage("a", 1000, true),
+			alertMessage("b", 1000, true),
+			manifestMessage(4000, false),
+		}, []string{"raise web1/a", "raise web1/b", "clear web1/a", "clear web1/b"}},
+	}
+	for _, tc := range testCases {
+		got := convertAll(tc.skipRetained, tc.msgs...)
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestConvertAlerts(t *testing.T) {
+	al := mauve.NewAlert("disk", mauve.WithSubject("db1"), mauve.WithSummary("Disk full"), mauve.RaiseAfter(0))
+	pb, _ := proto.Marshal(al)
+	js, _ := mauve.MarshalAlertJSON("web/1", al)
+	claims, _ := mauve.MarshalAlertJSON("someone-else", al)
+	topic := testTopics.Topic("web/1", al)
+	testCases := []struct {
+		name string
+		msg  *message
+		// The source the alert should be passed on from, or empty if it
+		// should be skipped
+		source string
+	}{
+		{"protobuf", &message{Topic: topic, Payload: pb}, "web/1"},
+		{"JSON", &message{Topic: topic, Payload: js}, "web/1"},
+		{"MQTT 5 content type", &message{Topic: topic, Payload: pb, ContentType: mauve.ContentTypeProtobuf, Source: "web/1"}, "web/1"},
+		{"source claimed in the payload", &message{Topic: topic, Payload: claims}, "web/1"},
+		{"another base topic", &message{Topic: "other/db1/web%2F1/disk", Payload: pb}, ""},
+		{"too few levels", &message{Topic: "govealert/db1/disk", Payload: pb}, ""},
+		{"bad escaping", &message{Topic: "govealert/db1/web%zz/disk", Payload: pb}, ""},
+		{"not an alert", &message{Topic: topic, Payload: []byte("{not json")}, ""},
+		{"wrong content type", &message{Topic: topic, Payload: js, ContentType: mauve.ContentTypeProtobuf}, ""},
+		{"deleted retained alert", &message{Topic: topic, Retained: true}, ""},
+	}
+	for _, tc := range testCases {
+		inc := make(chan *message, 1)
+		inc <- tc.msg
+		close(inc)
+		out := make(chan *mauve.AlertUpdate, 1)
+		convertStreaming(testTopics, false, inc, out)
+		close(out)
+		up := <-out
+		if tc.source == "" {
+			if up != nil {
+				t.Errorf("%s: expected the message to be skipped, got %v", tc.name, up)
+			}
+			continue
+		}
+		if up == nil {
+			t.Errorf("%s: expected an update, got nothing", tc.name)
+			continue
+		}
+		if up.GetSource() != tc.source || up.GetReplace() || up.GetTransmissionId() == 0 || len(up.Alert) != 1 {
+			t.Errorf("%s: wrong update: %v", tc.name, up)
+		} else if !proto.Equal(up.Alert[0], al) {
+			t.Errorf("%s: expected %v to be passed on, got %v", tc.name, al, up.Alert[0])
+		}
+	}
+}
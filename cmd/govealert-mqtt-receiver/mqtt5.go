@@ -0,0 +1,100 @@
+//go:build mqtt5
+// +build mqtt5
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/jiphex/govealert/mauve"
+)
+
+// The same as dialMQTT, but speaking MQTT 5, which gives us the content
+// type and source of each alert from its properties.
+func dialMQTT5(broker string, topics *mauve.TopicScheme, qos byte, auth mqttAuth) (publisher, chan *message) {
+	incomingMessages := make(chan *message)
+	ctx, cancel := context.WithTimeout(context.Background(), auth.ConnectTimeout)
+	defer cancel()
+	conn, err := mauve.DialBroker(ctx, broker, auth.TLSConfig)
+	if err != nil {
+		log.Fatalf("Failed to connect to MQTT Broker: %s - %s", broker, err)
+	}
+	router := paho.NewSingleHandlerRouter(func(p *paho.Publish) {
+		log.Printf("Packet on %s", p.Topic)
+		m := &message{Topic: p.Topic, Payload: p.Payload, Retained: p.Retain}
+		if p.Properties != nil {
+			m.ContentType = p.Properties.ContentType
+			m.Source = p.Properties.User.Get("source")
+			m.Published, _ = strconv.ParseInt(p.Properties.User.Get("published"), 10, 64)
+		}
+		incomingMessages <- m
+	})
+	hostname, _ := os.Hostname()
+	clientId := auth.ClientIDPrefix + hostname
+	client := paho.NewClient(paho.ClientConfig{
+		ClientID: clientId,
+		Conn:     conn,
+		Router:   router,
+		OnClientError: func(err error) {
+			log.Fatalf("Lost MQTT Connection because: %s", err)
+		},
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			log.Fatalf("Lost MQTT Connection because the broker disconnected us, reason %d", d.ReasonCode)
+		},
+	})
+	// Keep the session forever, as with MQTT 3
+	never := uint32(0xFFFFFFFF)
+	ca, err := client.Connect(ctx, &paho.Connect{
+		ClientID:     clientId,
+		KeepAlive:    30,
+		CleanStart:   false,
+		Username:     auth.Username,
+		UsernameFlag: auth.Username != "",
+		Password:     []byte(auth.Password),
+		PasswordFlag: auth.Password != "",
+		Properties:   &paho.ConnectProperties{SessionExpiryInterval: &never},
+		WillMessage: &paho.WillMessage{
+			Retain:  true,
+			QoS:     1,
+			Topic:   mqttHeartbeatTopic(topics.Base),
+			Payload: mqttStatusPacket(false),
+		},
+		WillProperties: &paho.WillProperties{ContentType: mauve.ContentTypeJSON},
+	})
+	if err != nil {
+		log.Fatalf("Failed to connect to MQTT Broker: %s - %s", broker, err)
+	} else if ca.ReasonCode >= 0x80 {
+		log.Fatalf("Failed to connect to MQTT Broker: %s - reason %d", broker, ca.ReasonCode)
+	}
+	log.Printf("Connected to Broker")
+	// Alerts, and the manifests sent for replaces
+	filters := []string{topics.Filter(), topics.ManifestFilter()}
+	subs := make([]paho.SubscribeOptions, len(filters))
+	for i, filter := range filters {
+		subs[i] = paho.SubscribeOptions{Topic: filter, QoS: qos}
+	}
+	sa, err := client.Subscribe(context.Background(), &paho.Subscribe{Subscriptions: subs})
+	if err != nil {
+		log.Fatalf("Failed to subscribe to %v: %s", filters, err)
+	}
+	for i, reason := range sa.Reasons {
+		if reason >= 0x80 && i < len(filters) {
+			log.Fatalf("Failed to subscribe to %s: reason %d", filters[i], reason)
+		}
+	}
+	publish := func(topic string, payload []byte) error {
+		_, err := client.Publish(context.Background(), &paho.Publish{
+			QoS:        1,
+			Retain:     true,
+			Topic:      topic,
+			Payload:    payload,
+			Properties: &paho.PublishProperties{ContentType: mauve.ContentTypeJSON},
+		})
+		return err
+	}
+	return publish, incomingMessages
+}
@@ -0,0 +1,15 @@
+//go:build !mqtt5
+// +build !mqtt5
+
+package main
+
+import (
+	"log"
+
+	"github.com/jiphex/govealert/mauve"
+)
+
+func dialMQTT5(broker string, topics *mauve.TopicScheme, qos byte, auth mqttAuth) (publisher, chan *message) {
+	log.Fatalf("This build doesn't support MQTT 5, it needs the mqtt5 build tag")
+	return nil, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jiphex/govealert/mauve"
+)
+
+// Exit statuses for when the command didn't exit by itself, as used by
+// timeout(1) and the shell.
+const (
+	exitTimedOut = 124
+	exitNotRun   = 127
+)
+
+// The result of running a command for exec mode.
+type commandResult struct {
+	Args       []string
+	ExitStatus int
+	Runtime    time.Duration
+	TimedOut   bool
+	// Set if the command couldn't be run at all
+	Err error
+	// The end of what the command wrote to stderr
+	Stderr string
+}
+
+func (r *commandResult) Failed() bool {
+	return r.ExitStatus != 0
+}
+
+// Keeps the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+// The last n lines kept, dropping any partial first line if the buffer
+// filled up.
+func (t *tailBuffer) lines(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := t.buf
+	if len(t.buf) == t.max {
+		if i := bytes.IndexByte(out, '\n'); i >= 0 {
+			out = out[i+1:]
+		}
+	}
+	lines := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// How long to wait for the command's output to close after it's been
+// killed, in case something it started has escaped its process group.
+const killWait = 5 * time.Second
+
+var errStillRunning = errors.New("command still running after being killed")
+
+// Run a command, passing its output through, and stopping it if it's still
+// going after timeout (if non-zero). The last tailLines lines of stderr are
+// kept for the alert.
+//
+// The command gets its own process group, so that on a timeout (or if
+// govealert is interrupted) anything it's started is killed too, rather
+// than being left holding stderr open. That puts it in the background as far
+// as the terminal's concerned, so it can't read from one: it's only given
+// stdin when that isn't a terminal, and otherwise reads nothing.
+func runCommand(args []string, timeout time.Duration, tailLines int) *commandResult {
+	tail := &tailBuffer{max: 4096}
+	cmd := exec.Command(args[0], args[1:]...)
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice == 0 {
+		cmd.Stdin = os.Stdin
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = io.MultiWriter(os.Stderr, tail)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	res := &commandResult{Args: args}
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		res.Err = err
+		res.ExitStatus = exitNotRun
+		return res
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var err error
+	var killed syscall.Signal
+	select {
+	case err = <-done:
+	case sig := <-sigs:
+		killed = sig.(syscall.Signal)
+	case <-expired:
+		res.TimedOut = true
+		killed = syscall.SIGKILL
+	}
+	if killed != 0 {
+		syscall.Kill(-cmd.Process.Pid, killed)
+		select {
+		case err = <-done:
+		case <-time.After(killWait):
+			// Something it started has escaped and is holding stderr open
+			err = errStillRunning
+		}
+	}
+	res.Runtime = time.Since(start)
+	res.ExitStatus = exitStatus(err, killed)
+	if res.TimedOut {
+		res.ExitStatus = exitTimedOut
+	}
+	res.Stderr = tail.lines(tailLines)
+	return res
+}
+
+// The shell's idea of the exit status for the error from cmd.Wait, where a
+// process killed by a signal exits with 128 plus the signal.
+func exitStatus(err error, killed syscall.Signal) int {
+	switch e := err.(type) {
+	case nil:
+		return 0
+	case *exec.ExitError:
+		if ws, ok := e.Sys().(syscall.WaitStatus); ok {
+			if ws.Signaled() {
+				return 128 + int(ws.Signal())
+			}
+			return ws.ExitStatus()
+		}
+	}
+	if killed != 0 {
+		return 128 + int(killed)
+	}
+	return 1
+}
+
+// A one line description of what went wrong.
+func (r *commandResult) Summary() string {
+	name := filepath.Base(r.Args[0])
+	switch {
+	case r.Err != nil:
+		return fmt.Sprintf("%s couldn't be run", name)
+	case r.TimedOut:
+		return fmt.Sprintf("%s timed out after %s", name, r.Runtime-r.Runtime%time.Second)
+	}
+	return fmt.Sprintf("%s failed with exit status %d", name, r.ExitStatus)
+}
+
+// The alert detail, which Mauve shows as HTML, so everything from the
+// command is escaped.
+func (r *commandResult) Detail() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<p>Command: <code>%s</code></p>\n", html.EscapeString(strings.Join(r.Args, " ")))
+	if r.Err != nil {
+		fmt.Fprintf(&b, "<p>Error: %s</p>\n", html.EscapeString(r.Err.Error()))
+	} else if r.TimedOut {
+		fmt.Fprintf(&b, "<p>Timed out, and was killed</p>\n")
+	} else {
+		fmt.Fprintf(&b, "<p>Exit status: %d</p>\n", r.ExitStatus)
+	}
+	fmt.Fprintf(&b, "<p>Runtime: %s</p>\n", r.Runtime-r.Runtime%time.Millisecond)
+	if r.Stderr != "" {
+		fmt.Fprintf(&b, "<p>End of stderr:</p>\n<pre>%s</pre>\n", html.EscapeString(r.Stderr))
+	}
+	return b.String()
+}
+
+// The alert to send for the command's result: a raise if it failed, or a
+// clear of the same alert if it succeeded. opts are added to both, and a
+// summary given in them is used rather than the generated one.
+func commandAlert(id string, res *commandResult, opts ...mauve.AlertOption) *mauve.Alert {
+	if !res.Failed() {
+		return mauve.NewAlert(id, append(opts, mauve.ClearAfter(0))...)
+	}
+	summary := []rune(res.Summary())
+	if len(summary) > mauve.MaxSummaryLength {
+		summary = summary[:mauve.MaxSummaryLength]
+	}
+	failed := []mauve.AlertOption{mauve.WithSummary(string(summary)), mauve.WithDetail(res.Detail()), mauve.RaiseAfter(0)}
+	return mauve.NewAlert(id, append(failed, opts...)...)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jiphex/govealert/mauve"
+)
+
+func TestTailBufferLines(t *testing.T) {
+	testCases := []struct {
+		max     int
+		written string
+		n       int
+		lines   string
+	}{
+		{4096, "", 5, ""},
+		{4096, "one\ntwo\n", 5, "one\ntwo"},
+		{4096, "one\ntwo\nthree\n", 2, "two\nthree"},
+		{4096, "no newline", 5, "no newline"},
+		// The buffer filled up, so the first line is only part of one
+		{10, "first line\nsecond\n", 5, "second"},
+		{4096, "one\ntwo\n", 0, ""},
+		{4096, "one\ntwo\n", -1, ""},
+	}
+	for _, tc := range testCases {
+		tb := &tailBuffer{max: tc.max}
+		// In pieces, as a command would write it
+		for _, c := range strings.SplitAfter(tc.written, "\n") {
+			tb.Write([]byte(c))
+		}
+		if got := tb.lines(tc.n); got != tc.lines {
+			t.Errorf("Last %d lines of %q should be %q, got %q", tc.n, tc.written, tc.lines, got)
+		}
+	}
+}
+
+func TestCommandAlert(t *testing.T) {
+	opts := []mauve.AlertOption{mauve.WithSubject("db1")}
+	ok := commandAlert("backup", &commandResult{Args: []string{"backup.sh"}}, opts...)
+	if ok.GetClearTime() == 0 || ok.GetRaiseTime() != 0 || ok.GetSubject() != "db1" {
+		t.Errorf("Success should clear the alert, got %s", ok)
+	}
+	failed := commandAlert("backup", &commandResult{Args: []string{"/usr/local/bin/backup.sh"}, ExitStatus: 3}, opts...)
+	if failed.GetRaiseTime() == 0 || failed.GetClearTime() != 0 {
+		t.Errorf("Failure should raise the alert, got %s", failed)
+	}
+	if failed.GetSummary() != "backup.sh failed with exit status 3" {
+		t.Errorf("Wrong summary for a failure: %s", failed.GetSummary())
+	}
+	given := commandAlert("backup", &commandResult{Args: []string{"backup.sh"}, ExitStatus: 1}, append(opts, mauve.WithSummary("backups are broken"))...)
+	if given.GetSummary() != "backups are broken" {
+		t.Errorf("A given summary should be used, got %s", given.GetSummary())
+	}
+	long := commandAlert("backup", &commandResult{Args: []string{strings.Repeat("é", 200)}, ExitStatus: 1})
+	if err := long.Validate(); err != nil {
+		t.Errorf("Summary should have been cut to fit, got %s", err)
+	}
+}
+
+func TestCommandDetail(t *testing.T) {
+	res := &commandResult{Args: []string{"sh", "-c", "echo '<b>' >&2"}, ExitStatus: 1, Stderr: "<script>alert(1)</script> & more"}
+	detail := res.Detail()
+	for _, bad := range []string{"<script>", "<b>", "& more"} {
+		if strings.Contains(detail, bad) {
+			t.Errorf("Detail should have %q escaped: %s", bad, detail)
+		}
+	}
+	if !strings.Contains(detail, "&lt;script&gt;alert(1)&lt;/script&gt; &amp; more") {
+		t.Errorf("Detail is missing the escaped stderr: %s", detail)
+	}
+	if !strings.Contains(detail, "Exit status: 1") {
+		t.Errorf("Detail is missing the exit status: %s", detail)
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	testCases := []struct {
+		args     []string
+		timeout  time.Duration
+		status   int
+		timedOut bool
+	}{
+		{[]string{"true"}, 0, 0, false},
+		{[]string{"sh", "-c", "exit 3"}, 0, 3, false},
+		{[]string{"/nonexistent/command"}, 0, exitNotRun, false},
+		{[]string{"sh", "-c", "kill -9 $$"}, 0, 128 + 9, false},
+		{[]string{"sleep", "10"}, 100 * time.Millisecond, exitTimedOut, true},
+		// The shell's child keeps stderr open, so it needs killing too
+		{[]string{"sh", "-c", "sleep 10; echo done"}, 100 * time.Millisecond, exitTimedOut, true},
+	}
+	for _, tc := range testCases {
+		res := runCommand(tc.args, tc.timeout, 20)
+		if res.ExitStatus != tc.status || res.TimedOut != tc.timedOut {
+			t.Errorf("%v: expected status %d (timed out %t), got %d (%t)", tc.args, tc.status, tc.timedOut, res.ExitStatus, res.TimedOut)
+		}
+		if tc.timedOut && res.Runtime > 5*time.Second {
+			t.Errorf("%v: took %s to time out", tc.args, res.Runtime)
+		}
+	}
+	res := runCommand([]string{"sh", "-c", "echo one >&2; echo two >&2; exit 1"}, 0, 1)
+	if res.Stderr != "two" {
+		t.Errorf("Expected the last line of stderr, got %q", res.Stderr)
+	}
+}
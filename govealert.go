@@ -1,94 +1,347 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"	
+	"log"
 	"os"
+	"strings"
+	"time"
+
 	"code.google.com/p/go.net/publicsuffix"
 	"github.com/jiphex/govealert/mauve"
 )
 
+// Appended to the help for each of the time flags
+const timeHelp = " (now, a duration like +10m or -5m, a UNIX time, RFC3339, 2006-01-02T15:04, 17:30 or 'tomorrow 09:00')"
+
 func main() {
 	hostname, _ := os.Hostname()
 	// we need to do some wrangling to get the default domain
-	psname,err := publicsuffix.EffectiveTLDPlusOne(hostname)
+	psname, err := publicsuffix.EffectiveTLDPlusOne(hostname)
 	if err != nil {
 		psname = hostname // shrug
-	} 
+	}
+	// The mode can also be given as the first argument, e.g. "govealert flush-spool"
+	// or "govealert exec --id backup -- /usr/local/bin/backup"
+	args := os.Args[1:]
+	subcommand := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		subcommand, args = args[0], args[1:]
+	}
 	id := flag.String("id", "govealert", "Alert ID to send")
 	subject := flag.String("subject", hostname, "What the alert is about")
 	summary := flag.String("summary", "", "Short text desription of the alert")
 	detail := flag.String("detail", "", "Longer textual description of the alert")
 	source := flag.String("source", hostname, "The thing that generated the alert")
-	raise := flag.String("raise", "now", "Time to raise the alert")
-	clear := flag.String("clear", "", "Time to clear the alert")
+	raise := flag.String("raise", "now", "Time to raise the alert"+timeHelp)
+	clear := flag.String("clear", "", "Time to clear the alert"+timeHelp)
 	replace := flag.Bool("replace", false, "Replace all alerts for this subject")
-	mauvealert := flag.String("mauve", psname, "Mauve server to dial (will lookup _mauve._udp SRV record of this domain)")
-	suppress := flag.String("suppress", "", "Suppress alert for the specified time")
-	mode := flag.String("mode", "single", "Sending mode, one of: single, heartbeat")	
+	mauvealert := flag.String("mauve", psname, "Mauve server to dial, either host:port or a domain to look up the _mauvealert._udp SRV records of")
+	srvPolicy := flag.String("srv-policy", "all", "Which of the SRV records to send to: all, priority (only the lowest priority) or weighted (one at a time, moving on only if one can't be looked up or written to)")
+	suppress := flag.String("suppress", "", "Suppress alert until the specified time"+timeHelp)
+	importance := flag.String("importance", "", "Importance of the alert: low, normal, high, urgent or a number (default is the server's)")
+	mode := flag.String("mode", "single", "Sending mode, one of: single, heartbeat (or deadman), exec, flush-spool")
 	cancel := flag.Bool("cancel", false, "In 'heartbeat' mode, cancels the heartbeat (via suppress+raise, clear)")
+	interval := flag.Duration("interval", 5*time.Minute, "In 'heartbeat' mode, how often the heartbeat is expected to be sent")
+	grace := flag.Duration("grace", 5*time.Minute, "In 'heartbeat' mode, how late a heartbeat can be before the alert is raised")
+	execTimeout := flag.Duration("timeout", 0, "In 'exec' and 'heartbeat' modes, how long to let the command run before killing it and raising the alert (0 for no limit)")
+	stderrLines := flag.Int("stderr-lines", 20, "In 'exec' mode, how many lines from the end of the command's stderr to put in the alert (0 for none)")
 	transport := flag.String("transport", "protobuf", "Which transport to use, currently one of: protobuf, mqtt")
 	mqttBroker := flag.String("mqttBroker", "tcp://localhost:1883", "The MQTT Broker to connect to")
 	mqttTopic := flag.String("mqttBase", "govealert", "Base topic for MQTT transport packets")
-	flag.Parse()
+	mqttTopicTemplate := flag.String("mqtt-topics", mauve.DefaultTopicTemplate, "Layout of alert topics: v1 ({base}/{subject}/{source}/{id}), legacy ({base}/{source}/{subject}/{id}) or a template of your own")
+	mqttCA := flag.String("mqtt-ca", "", "PEM bundle of CAs to trust for an ssl:// or tls:// MQTT broker, instead of the system's")
+	mqttCert := flag.String("mqtt-cert", "", "PEM client certificate to present to the MQTT broker")
+	mqttKey := flag.String("mqtt-key", "", "PEM key for -mqtt-cert")
+	mqttServerName := flag.String("mqtt-server-name", "", "Name to check the MQTT broker's certificate against, if not the host in -mqttBroker")
+	mqttTimeout := flag.Duration("mqtt-connect-timeout", mauve.DefaultMQTTConnectTimeout, "How long to wait to connect to the MQTT broker")
+	mqttVersion := flag.Int("mqtt-version", 3, "Version of MQTT to speak to the broker: 3 or 5 (if built with the mqtt5 tag)")
+	mqttRaiseExpiry := flag.Duration("mqtt-raise-expiry", 0, "With MQTT 5, how long the broker should keep raises which haven't been delivered for (0 for ever)")
+	mqttQoS := flag.Uint("mqtt-qos", 1, "QoS to publish alerts with: 0, 1 or 2")
+	mqttRetain := flag.Bool("mqtt-retain", false, "Publish alerts retained, so each alert's topic holds its last state")
+	mqttPersistent := flag.Bool("mqtt-persistent", false, "Keep the MQTT session between connections, using a fixed client ID")
+	mqttClientID := flag.String("mqtt-client-id", "", "Fixed MQTT client ID to use instead of -mqtt-client-id-prefix and a random string (default with -mqtt-persistent is the prefix without the trailing \"-\")")
+	mqttEncoding := flag.String("mqtt-encoding", mauve.EncodingProtobuf, "How to encode alerts published over MQTT: protobuf or json")
+	mqttUsername := flag.String("mqtt-username", "", "Username for the MQTT broker")
+	mqttPasswordFile := flag.String("mqtt-password-file", "", "File containing the password (or token) for the MQTT broker, otherwise it's taken from $"+mauve.MQTTPasswordEnv)
+	mqttClientIDPrefix := flag.String("mqtt-client-id-prefix", "govealert-"+hostname+"-", "Start of the MQTT client ID, which is followed by a random string")
+	secretFile := flag.String("secret-file", "", "File containing a shared secret used to sign alerts (protobuf transport only)")
+	strict := flag.Bool("strict", false, "Refuse to send alerts which break the protocol rules (e.g. summary over 100 characters)")
+	dnsCache := flag.String("dns-cache", "", "File to cache the Mauve servers found in DNS in (e.g. /var/cache/govealert/mauve.json)")
+	dnsCacheTTL := flag.Duration("dns-cache-ttl", 5*time.Minute, "How long to use cached Mauve servers for before looking them up again")
+	dnsCacheMaxStale := flag.Duration("dns-cache-max-stale", 7*24*time.Hour, "How long past -dns-cache-ttl cached servers can still be used if DNS is failing (0 for no limit)")
+	mauveHosts := flag.String("mauve-hosts-file", "", "File listing the Mauve servers of domains to use instead of DNS, see mauve.StaticResolver")
+	dnsServer := flag.String("dns-server", "", "DNS server (host[:port]) to look up Mauve servers with instead of the system's")
+	udpRepeat := flag.Int("udp-repeat", 1, "How many copies of each update to send over UDP (protobuf transport only)")
+	udpInterval := flag.Duration("udp-interval", 200*time.Millisecond, "Roughly how long to wait between each copy sent with -udp-repeat")
+	udpRetries := flag.Int("udp-retries", 2, "How many times to retry a failed UDP write to each Mauve server")
+	spoolDir := flag.String("spool", "", "Directory to keep alerts which couldn't be sent in, to retry on the next run (e.g. /var/spool/govealert)")
+	spoolMaxAge := flag.Duration("spool-max-age", time.Hour, "Spooled raises older than this are dropped rather than resent (clears are always resent)")
+	flag.CommandLine.Parse(args)
+	if subcommand != "" {
+		*mode = subcommand
+	}
+	if *mode == "deadman" {
+		*mode = "heartbeat"
+	}
 	if len(*clear) > 0 && *raise == "now" {
 		*raise = "" // This is supposed to stop the unstated "raise now" if a clear is passed with no raise argument
 	}
-	var client mauve.AlertSender;
-	if *transport == "mqtt" {
-		client,err = mauve.CreateMQTTClient(*source, *mqttBroker, *mqttTopic)
-	} else if *transport == "protobuf" {
-		client,err = mauve.CreateProtobufClient(*source,*mauvealert)
-	} else {
+	// Anything wrong with the flags is fatal straight away, before anything
+	// is run or spooled
+	policy, err := mauve.ParseSRVPolicy(*srvPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *stderrLines < 0 {
+		log.Fatalf("Bad -stderr-lines %d, should be 0 (for none) or more", *stderrLines)
+	}
+	switch *transport {
+	case "mqtt":
+		if *mqttQoS > 2 {
+			log.Fatalf("Bad -mqtt-qos %d, should be 0, 1 or 2", *mqttQoS)
+		}
+		if *mqttVersion != 3 && *mqttVersion != 5 {
+			log.Fatalf("Unknown -mqtt-version %d, should be 3 or 5", *mqttVersion)
+		} else if *mqttVersion == 5 && !mauve.MQTT5Supported {
+			log.Fatalf("This build doesn't support MQTT 5, it needs the mqtt5 build tag")
+		}
+		// Checked now, so a bad template isn't taken as a failure to send
+		if _, err := mauve.NewTopicScheme(*mqttTopic, *mqttTopicTemplate); err != nil {
+			log.Fatal(err)
+		}
+		if _, err := mauve.ParseEncoding(*mqttEncoding); err != nil {
+			log.Fatal(err)
+		}
+	case "protobuf":
+	default:
 		log.Fatalf("Unknown alert transport: %s", *transport)
 	}
-	if err != nil {
-		log.Printf("Failed to create %s client: %s", *transport, err)
+	newClient := func() (mauve.Sender, error) {
+		if *transport == "mqtt" {
+			mqc, err := mauve.CreateMQTTClient(*source, *mqttBroker, *mqttTopic)
+			if err != nil {
+				return nil, err
+			}
+			mqc.Strict = *strict
+			mqc.Username, mqc.ClientIDPrefix = *mqttUsername, *mqttClientIDPrefix
+			mqc.ConnectTimeout = *mqttTimeout
+			mqc.Retain, mqc.Persistent = *mqttRetain, *mqttPersistent
+			mqc.ClientID = *mqttClientID
+			if mqc.Persistent && mqc.ClientID == "" {
+				mqc.ClientID = strings.TrimSuffix(mqc.ClientIDPrefix, "-")
+			}
+			mqc.QoS = byte(*mqttQoS)
+			mqc.MQTTVersion, mqc.RaiseExpiry = *mqttVersion, *mqttRaiseExpiry
+			mqc.TopicTemplate = *mqttTopicTemplate
+			mqc.Encoding, _ = mauve.ParseEncoding(*mqttEncoding)
+			if mqc.Password, err = mauve.ReadMQTTPassword(*mqttPasswordFile); err != nil {
+				return nil, err
+			}
+			if *mqttCA != "" || *mqttCert != "" || *mqttKey != "" || *mqttServerName != "" {
+				if mqc.TLSConfig, err = mauve.NewTLSConfig(*mqttCA, *mqttCert, *mqttKey, *mqttServerName); err != nil {
+					return nil, err
+				}
+			}
+			return mqc, nil
+		}
+		opts := []mauve.ProtobufOption{mauve.WithRepeat(*udpRepeat, *udpInterval), mauve.WithRetries(*udpRetries), mauve.WithSRVPolicy(policy)}
+		resolver, err := mauve.OpenResolver(*mauveHosts, *dnsServer)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to set up resolver: %s", err)
+		}
+		if resolver != nil {
+			opts = append(opts, mauve.WithResolver(resolver))
+		}
+		if *dnsCache != "" {
+			opts = append(opts, mauve.WithServiceCache(&mauve.ServiceCache{Path: *dnsCache, TTL: *dnsCacheTTL, MaxStale: *dnsCacheMaxStale}))
+		}
+		pbc, err := mauve.CreateProtobufClient(*source, *mauvealert, opts...)
+		if err != nil {
+			return nil, err
+		}
+		pbc.Strict = *strict
+		if *secretFile != "" {
+			if pbc.Secret, err = mauve.ReadSecretFile(*secretFile); err != nil {
+				return nil, err
+			}
+		}
+		return pbc, nil
+	}
+
+	// The spool is opened first, so an alert can still be spooled if the
+	// client can't be made (e.g. if looking up the Mauve servers fails).
+	var spool *mauve.Spool
+	if *spoolDir != "" {
+		if spool, err = mauve.OpenSpool(*spoolDir, *spoolMaxAge); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// The client is only made once there's something to send.
+	var client mauve.Sender
+	// Why the spool couldn't be flushed, if it couldn't
+	var flushErr error
+	connect := func() error {
+		if client != nil {
+			return nil
+		}
+		c, err := newClient()
+		if err != nil {
+			return fmt.Errorf("Failed to create %s client: %s", *transport, err)
+		}
+		client = c
+		// Anything left over from last time goes first, so the alerts arrive in order
+		if spool != nil {
+			if n, err := spool.Flush(context.Background(), client); err != nil {
+				log.Printf("Failed to flush spool (%d sent): %s", n, err)
+				flushErr = err
+			} else if n > 0 {
+				log.Printf("Sent %d spooled updates", n)
+			}
+		}
+		return nil
+	}
+	// os.Exit skips deferred calls, so this needs calling before it too.
+	closeClient := func() {
+		if client != nil {
+			client.Close()
+		}
+	}
+	defer closeClient()
+	spoolUpdate := func(up *mauve.AlertUpdate, err error) error {
+		path, serr := spool.Put(up)
+		if serr != nil {
+			return fmt.Errorf("%s, and failed to spool it: %s", err, serr)
+		}
+		log.Print(&mauve.SpooledError{Err: err, Path: path})
+		return nil
+	}
+	// Send a single update, spooling it if it couldn't be delivered.
+	send := func(replace bool, alerts ...*mauve.Alert) error {
+		up := mauve.CreateUpdate(*source, replace, alerts...)
+		if err := connect(); err != nil {
+			if spool == nil {
+				return err
+			}
+			return spoolUpdate(up, err)
+		}
+		if spool == nil {
+			return client.Send(context.Background(), up)
+		}
+		// If older updates are still stuck in the spool this one has to
+		// wait behind them, or it could be overtaken by them next time
+		if flushErr != nil {
+			if left, err := spool.Entries(); err != nil || len(left) > 0 {
+				return spoolUpdate(up, fmt.Errorf("Spool not flushed: %s", flushErr))
+			}
+		}
+		err := spool.SendOrSpool(context.Background(), client, up)
+		if _, ok := err.(*mauve.SpooledError); ok {
+			log.Print(err)
+			return nil
+		}
+		return err
 	}
-	if *mode == "heartbeat" {
-		hbsumm := fmt.Sprintf("heartbeat failed for %s", hostname)
-		hbdetail := fmt.Sprintf("The govealert heartbeat wasn't sent for the host %s.", hostname)
+
+	if *mode == "flush-spool" {
+		if spool == nil {
+			log.Fatalf("No -spool directory given to flush")
+		}
+		// Connecting flushes the spool, so then just check it's empty
+		if err := connect(); err != nil {
+			log.Fatal(err)
+		}
+		left, err := spool.Entries()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(left) > 0 {
+			log.Fatalf("%d updates are still spooled in %s", len(left), spool.Dir)
+		}
+	} else if *mode == "heartbeat" {
+		// If a command is given the heartbeat is only sent when it succeeds
 		hbid := "heartbeat"
-		hbraise := "+10m"
-		hbclear := "now"
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "id" {
+				hbid = *id
+			}
+		})
+		imp, err := mauve.ParseImportance(*importance)
+		if err != nil {
+			log.Fatal(err)
+		}
+		hb := newHeartbeat(hbid, *subject, *summary, *detail, imp, *interval, *grace)
 		if *cancel {
-			// Cancel a heartbeat alert by sending: suppressed raise, clear (experimental)
-			//log.Printf("Cancelling alert heartbeat")
-			supraise := "now"
-			suptime := "+5m"
-			sup,err := mauve.CreateAlert(hbid, supraise, hbclear, hostname, hbsumm, hbdetail, suptime)
-			if err != nil {
-				log.Fatalf("Failed to create heartbeat suppression alert: %s", err)
+			if err := send(false, hb.Cancel()...); err != nil {
+				log.Fatalf("Failed to cancel heartbeat: %s", err)
 			}
-			client.AddBatchedAlert(sup)
-			clr,err := mauve.CreateAlert(hbid, hbclear, supraise, hostname, hbsumm, hbdetail, hbclear)
-			if err != nil {
-				log.Fatalf("Failed to create heartbeat raise+clear alert: %s", err)
+		} else if flag.NArg() > 0 {
+			// The command is run before anything's sent, so it always runs
+			res := runCommand(flag.Args(), *execTimeout, *stderrLines)
+			if res.Failed() {
+				// Left alone, the alert is raised when the last heartbeat runs out
+				log.Printf("%s, not sending heartbeat", res.Summary())
+				os.Exit(res.ExitStatus)
+			}
+			// The command's status is what's exited with, even if this fails
+			if err := send(false, hb.Beat()); err != nil {
+				log.Printf("Failed to send heartbeat: %s", err)
 			}
-			client.AddBatchedAlert(clr)
-			client.SendBatchedAlerts(false)
 		} else {
-			// 	Send a hearbeat alert (clear now, raise in 10 minutes - meant to be called every N where N < 5 minutes)
-			al,err := mauve.CreateAlert(hbid, hbraise, hbclear, hostname, hbsumm, hbdetail, hbclear)
-			if err != nil {
+			if err := send(false, hb.Beat()); err != nil {
 				log.Fatalf("Failed to send heartbeat: %s", err)
 			}
-			client.AddBatchedAlert(al)
-			client.SendBatchedAlerts(false)
 		}
-	} else {
+	} else if *mode == "exec" {
+		// Raise the alert if the command fails, clear it if it succeeds
+		if flag.NArg() == 0 {
+			log.Fatalf("No command given to exec, e.g. govealert exec --id backup -- /usr/local/bin/backup")
+		}
+		imp, err := mauve.ParseImportance(*importance)
 		if err != nil {
 			log.Fatal(err)
 		}
-		al,err := mauve.CreateAlert(*id, *raise, *clear, *subject, *summary, *detail, *suppress)
+		opts := []mauve.AlertOption{mauve.WithSubject(*subject), mauve.WithImportance(imp)}
+		if *summary != "" {
+			opts = append(opts, mauve.WithSummary(*summary))
+		}
+		// The command is run before anything's sent (or the client's even
+		// made), so it always runs, and govealert always exits with its status
+		res := runCommand(flag.Args(), *execTimeout, *stderrLines)
+		if res.Err != nil {
+			log.Printf("Failed to run %s: %s", flag.Arg(0), res.Err)
+		} else if res.TimedOut {
+			log.Printf("%s timed out after %s", flag.Arg(0), *execTimeout)
+		}
+		if err := send(false, commandAlert(*id, res, opts...)); err != nil {
+			log.Printf("Failed to send alert: %s", err)
+		}
+		closeClient()
+		os.Exit(res.ExitStatus)
+	} else if *mode == "single" {
+		imp, err := mauve.ParseImportance(*importance)
 		if err != nil {
-			log.Fatalf("Failed to create alert: %s", err)
+			log.Fatal(err)
 		}
-		client.AddBatchedAlert(al)
-		err = client.SendBatchedAlerts(*replace)
+		al, err := mauve.CreateAlertWithOptions(mauve.AlertOptions{
+			Id:         *id,
+			Raise:      *raise,
+			Clear:      *clear,
+			Subject:    *subject,
+			Summary:    *summary,
+			Detail:     *detail,
+			Suppress:   *suppress,
+			Importance: imp,
+		})
 		if err != nil {
+			log.Fatalf("Failed to create alert: %s", err)
+		}
+		if err := send(*replace, al); err != nil {
 			log.Fatal(err)
 		}
+	} else {
+		log.Fatalf("Unknown mode: %s", *mode)
 	}
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jiphex/govealert/mauve"
+)
+
+// main calls os.Exit, so it's run in a copy of the test binary, which runs
+// main with the arguments (one per line) in $GOVEALERT_TEST_ARGS.
+func TestMain(m *testing.M) {
+	if args := os.Getenv("GOVEALERT_TEST_ARGS"); args != "" {
+		os.Args = append([]string{"govealert"}, strings.Split(args, "\n")...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Run govealert with args, returning its exit status and output.
+func runGovealert(t *testing.T, args ...string) (int, string) {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "GOVEALERT_TEST_ARGS="+strings.Join(args, "\n"))
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return 0, string(out)
+	}
+	if ee, ok := err.(*exec.ExitError); ok {
+		return ee.Sys().(syscall.WaitStatus).ExitStatus(), string(out)
+	}
+	t.Fatalf("Failed to run govealert: %s", err)
+	return 0, ""
+}
+
+func TestClientErrors(t *testing.T) {
+	testCases := map[string][]string{
+		"lookup":      failingLookup,
+		"secret file": {"-mauve", "127.0.0.1:32741", "-secret-file", "/nonexistent/secret"},
+	}
+	for name, args := range testCases {
+		status, out := runGovealert(t, append(args, "-id", "test")...)
+		if status == 0 {
+			t.Errorf("%s: govealert should have failed, output:\n%s", name, out)
+		}
+		if strings.Contains(out, "panic") {
+			t.Errorf("%s: govealert panicked:\n%s", name, out)
+		}
+	}
+}
+
+// Nothing listens on port 1, so looking up Mauve with this fails.
+var failingLookup = []string{"-mauve", "example.invalid", "-dns-server", "127.0.0.1:1"}
+
+func TestSpoolWithoutClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "govealert-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	status, out := runGovealert(t, append(failingLookup, "-id", "test", "-spool", dir)...)
+	if status != 0 {
+		t.Fatalf("govealert should have spooled the alert and exited 0, got %d:\n%s", status, out)
+	}
+	sp, err := mauve.OpenSpool(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := sp.Entries(); len(entries) != 1 {
+		t.Errorf("Expected the alert to be spooled, the spool has %d updates", len(entries))
+	}
+}
+
+func TestExecWithoutClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "govealert-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ran := dir + "/ran"
+	args := append(failingLookup, "-id", "test", "--", "sh", "-c", "touch "+ran+"; exit 3")
+	status, out := runGovealert(t, append([]string{"exec"}, args...)...)
+	if _, err := os.Stat(ran); err != nil {
+		t.Errorf("The command should run even if the client can't be made:\n%s", out)
+	}
+	if status != 3 {
+		t.Errorf("govealert should exit with the command's status, got %d:\n%s", status, out)
+	}
+}
+
+func TestBadStderrLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "govealert-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ran := dir + "/ran"
+	status, out := runGovealert(t, "exec", "-id", "test", "-stderr-lines", "-1", "--", "touch", ran)
+	if status == 0 || strings.Contains(out, "panic") {
+		t.Errorf("govealert should have refused -stderr-lines -1, got %d:\n%s", status, out)
+	}
+	if _, err := os.Stat(ran); err == nil {
+		t.Errorf("The command shouldn't be run with bad flags")
+	}
+}
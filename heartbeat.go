@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jiphex/govealert/mauve"
+)
+
+// A dead man's switch: each heartbeat clears the alert and pushes its raise
+// time back, so it's raised if they stop for longer than Interval plus
+// Grace.
+type heartbeat struct {
+	Id       string
+	Interval time.Duration
+	Grace    time.Duration
+	Opts     []mauve.AlertOption
+}
+
+// A heartbeat about subject, with a default summary and detail unless
+// they're given.
+func newHeartbeat(id, subject, summary, detail string, importance uint32, interval, grace time.Duration) *heartbeat {
+	if summary == "" {
+		summary = fmt.Sprintf("heartbeat failed for %s", subject)
+	}
+	if detail == "" {
+		detail = fmt.Sprintf("The govealert heartbeat wasn't sent for %s.", subject)
+	}
+	return &heartbeat{
+		Id:       id,
+		Interval: interval,
+		Grace:    grace,
+		Opts:     []mauve.AlertOption{mauve.WithSubject(subject), mauve.WithSummary(summary), mauve.WithDetail(detail), mauve.WithImportance(importance)},
+	}
+}
+
+func (hb *heartbeat) alert(opts ...mauve.AlertOption) *mauve.Alert {
+	return mauve.NewAlert(hb.Id, append(append([]mauve.AlertOption{}, hb.Opts...), opts...)...)
+}
+
+// The alert to send for each heartbeat: clear now, raise if the next one
+// doesn't arrive in time.
+func (hb *heartbeat) Beat() *mauve.Alert {
+	return hb.alert(mauve.RaiseAfter(hb.Interval+hb.Grace), mauve.ClearAfter(0), mauve.SuppressFor(0))
+}
+
+// The alerts to send to cancel the heartbeat: a suppressed raise, then a
+// clear (experimental).
+func (hb *heartbeat) Cancel() []*mauve.Alert {
+	return []*mauve.Alert{
+		hb.alert(mauve.RaiseAfter(0), mauve.ClearAfter(0), mauve.SuppressFor(5*time.Minute)),
+		hb.alert(mauve.RaiseAfter(0), mauve.ClearAfter(0), mauve.SuppressFor(0)),
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jiphex/govealert/mauve"
+	"github.com/jiphex/govealert/mauvetest"
+)
+
+func TestHeartbeat(t *testing.T) {
+	srv, err := mauvetest.NewServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	pbc := &mauve.ProtobufClient{Hosts: []*mauve.MauveAlertService{srv.Service()}, Source: "test.example.com", Strict: true}
+	send := func(alerts ...*mauve.Alert) {
+		n := srv.Updates()
+		if err := pbc.Send(context.Background(), mauve.CreateUpdate(pbc.Source, false, alerts...)); err != nil {
+			t.Fatalf("Failed to send: %s", err)
+		}
+		if err := srv.WaitForUpdates(n+1, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hb := newHeartbeat("nightly", "db1.example.com", "", "", mauve.ImportanceUnspecified, time.Hour, 30*time.Minute)
+	send(hb.Beat())
+	as := srv.Alert("test.example.com", "nightly")
+	if as == nil {
+		t.Fatalf("Heartbeat didn't arrive")
+	}
+	if as.Alert.GetSubject() != "db1.example.com" || as.Alert.GetSummary() != "heartbeat failed for db1.example.com" {
+		t.Errorf("Heartbeat has the wrong subject or summary: %s", as.Alert)
+	}
+	now := time.Now()
+	for _, tc := range []struct {
+		at     time.Duration
+		raised bool
+	}{{0, false}, {time.Hour + 29*time.Minute, false}, {time.Hour + 31*time.Minute, true}} {
+		if as.Raised(now.Add(tc.at)) != tc.raised {
+			t.Errorf("Heartbeat after %s should have raised=%t", tc.at, tc.raised)
+		}
+	}
+
+	send(hb.Cancel()...)
+	as = srv.Alert("test.example.com", "nightly")
+	if as.Raised(now) || as.Raised(now.Add(24*time.Hour)) {
+		t.Errorf("Cancelled heartbeat shouldn't be raised, now or later")
+	}
+	if as.Suppressed(now) {
+		t.Errorf("Cancelled heartbeat should end up unsuppressed")
+	}
+}
@@ -0,0 +1,103 @@
+package mauve
+
+import (
+	"os"
+	"time"
+)
+
+// An AlertOption sets one of the fields of an Alert made by NewAlert.
+type AlertOption func(*alertBuilder)
+
+type alertBuilder struct {
+	alert *Alert
+	now   time.Time // so every relative option is relative to the same time
+}
+
+// Make an Alert with the given ID, e.g.
+//
+//	NewAlert("backup", WithSubject("db1"), RaiseAfter(time.Hour), ClearAfter(0))
+//
+// Unless WithSubject is given, the subject is the hostname.
+func NewAlert(id string, opts ...AlertOption) *Alert {
+	var zero uint64
+	raise, clear, suppress := zero, zero, zero
+	b := &alertBuilder{
+		alert: &Alert{
+			Id:            &id,
+			RaiseTime:     &raise,
+			ClearTime:     &clear,
+			SuppressUntil: &suppress,
+		},
+		now: time.Now(),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.alert.Subject == nil {
+		hn, _ := os.Hostname()
+		b.alert.Subject = &hn
+	}
+	return b.alert
+}
+
+// The UNIX time used in an Alert, where the zero time (or anything before
+// 1970) means unset.
+func alertTime(t time.Time) *uint64 {
+	var ut uint64
+	if !t.IsZero() && t.Unix() > 0 {
+		ut = uint64(t.Unix())
+	}
+	return &ut
+}
+
+func WithSubject(subject string) AlertOption {
+	return func(b *alertBuilder) { b.alert.Subject = &subject }
+}
+
+// The summary should be 100 characters or less.
+func WithSummary(summary string) AlertOption {
+	return func(b *alertBuilder) { b.alert.Summary = &summary }
+}
+
+// The detail can be an HTML fragment.
+func WithDetail(detail string) AlertOption {
+	return func(b *alertBuilder) { b.alert.Detail = &detail }
+}
+
+// One of the Importance constants, or any other number.
+func WithImportance(importance uint32) AlertOption {
+	return func(b *alertBuilder) {
+		if importance == ImportanceUnspecified {
+			b.alert.Importance = nil
+		} else {
+			b.alert.Importance = &importance
+		}
+	}
+}
+
+func RaiseAt(t time.Time) AlertOption {
+	return func(b *alertBuilder) { b.alert.RaiseTime = alertTime(t) }
+}
+
+// Raise the alert d from now, RaiseAfter(0) raises it straight away.
+func RaiseAfter(d time.Duration) AlertOption {
+	return func(b *alertBuilder) { b.alert.RaiseTime = alertTime(b.now.Add(d)) }
+}
+
+func ClearAt(t time.Time) AlertOption {
+	return func(b *alertBuilder) { b.alert.ClearTime = alertTime(t) }
+}
+
+// Clear the alert d from now, ClearAfter(0) clears it straight away.
+func ClearAfter(d time.Duration) AlertOption {
+	return func(b *alertBuilder) { b.alert.ClearTime = alertTime(b.now.Add(d)) }
+}
+
+func SuppressUntil(t time.Time) AlertOption {
+	return func(b *alertBuilder) { b.alert.SuppressUntil = alertTime(t) }
+}
+
+// Suppress notifications about the alert for d from now.
+func SuppressFor(d time.Duration) AlertOption {
+	return func(b *alertBuilder) { b.alert.SuppressUntil = alertTime(b.now.Add(d)) }
+}
@@ -0,0 +1,115 @@
+package mauve
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A ServiceCache keeps the Mauve servers found for each domain (and their
+// addresses) in a file, so that they don't need looking up on every run,
+// and can still be used when DNS is down.
+type ServiceCache struct {
+	Path string
+	// How long servers are used for before being looked up again. Go's
+	// resolver doesn't give the TTLs of the records it returns, so this
+	// stands in for them and should be set to no more than the SRV record's.
+	TTL time.Duration
+	// How long after expiring servers can still be used if looking them up
+	// again fails. Zero means there's no limit.
+	MaxStale time.Duration
+}
+
+type cacheEntry struct {
+	Hosts   []*MauveAlertService
+	Expires time.Time
+}
+
+func (sc *ServiceCache) load() map[string]*cacheEntry {
+	entries := make(map[string]*cacheEntry)
+	raw, err := ioutil.ReadFile(sc.Path)
+	if err != nil {
+		// A missing cache is just empty
+		return entries
+	}
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		log.Printf("Ignoring unreadable Mauve server cache %s: %s", sc.Path, err)
+		return make(map[string]*cacheEntry)
+	}
+	return entries
+}
+
+// Lots of runs may be writing the cache at once, so it's written to a
+// temporary file and renamed into place.
+func (sc *ServiceCache) save(entries map[string]*cacheEntry) error {
+	raw, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(sc.Path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(raw)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), sc.Path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// The same as LookupMauves, but using the cache where possible.
+func (sc *ServiceCache) LookupMauves(domain string, policy SRVPolicy) ([]*MauveAlertService, error) {
+	return sc.LookupMauvesWith(net.DefaultResolver, domain, policy)
+}
+
+// The same as LookupMauvesWith, but using the cache where possible.
+func (sc *ServiceCache) LookupMauvesWith(r Resolver, domain string, policy SRVPolicy) ([]*MauveAlertService, error) {
+	hosts, err := sc.lookup(r, domain)
+	if err != nil {
+		return nil, err
+	}
+	return selectServices(hosts, policy), nil
+}
+
+func (sc *ServiceCache) lookup(r Resolver, domain string) ([]*MauveAlertService, error) {
+	entries := sc.load()
+	now := time.Now()
+	cached, ok := entries[domain]
+	if ok && now.Before(cached.Expires) {
+		return cached.Hosts, nil
+	}
+	hosts, err := lookupMauveRecords(r, domain)
+	if err != nil {
+		if ok && (sc.MaxStale == 0 || now.Before(cached.Expires.Add(sc.MaxStale))) {
+			log.Printf("Using cached Mauve servers for %s as lookup failed: %s", domain, err)
+			return cached.Hosts, nil
+		}
+		return nil, err
+	}
+	// Resolve the addresses now too, so sending doesn't need DNS either
+	for _, mas := range hosts {
+		if ips, err := r.LookupIPAddr(context.Background(), mas.Host); err == nil && len(ips) > 0 {
+			mas.IP = ips[0].IP
+		}
+	}
+	entries[domain] = &cacheEntry{Hosts: hosts, Expires: now.Add(sc.TTL)}
+	if err := sc.save(entries); err != nil {
+		log.Printf("Failed to save Mauve server cache %s: %s", sc.Path, err)
+	}
+	return hosts, nil
+}
@@ -1,8 +1,9 @@
 package mauve
 
 import (
-	"net"
-	"fmt"
+	"context"
+	"errors"
+	"sync"
 )
 
 type AlertSender interface {
@@ -10,21 +11,47 @@ type AlertSender interface {
 	SendBatchedAlerts(replace bool) error
 }
 
-func LookupMauvesForDomain(domain string) ([]*MauveAlertService, error) {
-	cname,addrs,err := net.LookupSRV("mauvealert", "udp", domain)
-	if err != nil {
-		return nil,fmt.Errorf("Resolution error: %s", err)
-	}
-	if len(addrs) > 0 {
-		ret := make([]*MauveAlertService,len(addrs))
-		for i,srv := range addrs {
-			ret[i] = &MauveAlertService{
-				Host: srv.Target[0:len(srv.Target)-1],
-				Port: srv.Port,
-			}
-		}
-		return ret,nil
-	} else {
-		return nil,fmt.Errorf("Failed to find any Mauve records at %s", cname)
-	}
-}
\ No newline at end of file
+// Sender is the context-aware version of AlertSender, for long-running
+// programs which need to bound how long delivery takes and to release the
+// client's resources when they're done with it.
+type Sender interface {
+	AlertSender
+	// Send a complete AlertUpdate straight away, ignoring any batched alerts.
+	Send(ctx context.Context, update *AlertUpdate) error
+	// Send any batched alerts as a single (non-replacing) AlertUpdate.
+	Flush(ctx context.Context) error
+	// Release the client, after which any further sends will fail with ErrClosed.
+	Close() error
+}
+
+// ErrClosed is returned when sending with a client that has been closed.
+var ErrClosed = errors.New("mauve: client is closed")
+
+// A goroutine-safe queue of alerts waiting to be sent by one of the clients.
+type alertBatch struct {
+	mu     sync.Mutex
+	alerts []*Alert
+}
+
+func (b *alertBatch) add(alert *Alert) {
+	b.mu.Lock()
+	b.alerts = append(b.alerts, alert)
+	b.mu.Unlock()
+}
+
+// Remove and return everything that's been batched so far, so that a
+// concurrent add will end up in the next send rather than being lost.
+func (b *alertBatch) take() []*Alert {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	alerts := b.alerts
+	b.alerts = nil
+	return alerts
+}
+
+// Put alerts which failed to send back at the front of the queue.
+func (b *alertBatch) putBack(alerts []*Alert) {
+	b.mu.Lock()
+	b.alerts = append(alerts, b.alerts...)
+	b.mu.Unlock()
+}
@@ -0,0 +1,231 @@
+package mauve
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Resolver looks up Mauve servers and their addresses. Both *net.Resolver
+// and *StaticResolver are Resolvers.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// How to choose which of the Mauve servers in a domain's SRV records to
+// send to.
+type SRVPolicy int
+
+const (
+	// Send to every target, whatever its priority (the original behaviour).
+	SRVAll SRVPolicy = iota
+	// Send to every target with the lowest priority number.
+	SRVLowestPriority
+	// Send to one target at a time, in RFC 2782 order (by priority, then
+	// picked at random by weight), failing over to the next if it can't be
+	// looked up or written to. As it's UDP, a target that's down but
+	// reachable isn't noticed.
+	SRVWeighted
+)
+
+var srvPolicyNames = map[string]SRVPolicy{
+	"all":      SRVAll,
+	"priority": SRVLowestPriority,
+	"weighted": SRVWeighted,
+}
+
+func (p SRVPolicy) String() string {
+	for name, policy := range srvPolicyNames {
+		if policy == p {
+			return name
+		}
+	}
+	return fmt.Sprintf("SRVPolicy(%d)", int(p))
+}
+
+// Parse one of the policy names: all, priority or weighted.
+func ParseSRVPolicy(raw string) (SRVPolicy, error) {
+	if p, ok := srvPolicyNames[raw]; ok {
+		return p, nil
+	}
+	return SRVAll, fmt.Errorf("Unknown SRV policy %q, should be all, priority or weighted", raw)
+}
+
+// Find every Mauve server listed in the _mauvealert._udp SRV records of
+// the domain.
+func LookupMauvesForDomain(domain string) ([]*MauveAlertService, error) {
+	return LookupMauves(domain, SRVAll)
+}
+
+// Find the Mauve servers listed in the _mauvealert._udp SRV records of the
+// domain which the policy says to use, in the order they should be tried.
+func LookupMauves(domain string, policy SRVPolicy) ([]*MauveAlertService, error) {
+	return LookupMauvesWith(net.DefaultResolver, domain, policy)
+}
+
+// The same as LookupMauves, but using the given resolver rather than the
+// system's.
+func LookupMauvesWith(r Resolver, domain string, policy SRVPolicy) ([]*MauveAlertService, error) {
+	hosts, err := lookupMauveRecords(r, domain)
+	if err != nil {
+		return nil, err
+	}
+	return selectServices(hosts, policy), nil
+}
+
+// Every Mauve server in the domain's SRV records, whatever the policy.
+func lookupMauveRecords(r Resolver, domain string) ([]*MauveAlertService, error) {
+	cname, addrs, err := r.LookupSRV(context.Background(), "mauvealert", "udp", domain)
+	if err != nil {
+		return nil, fmt.Errorf("Resolution error: %s", err)
+	}
+	ret := recordsToServices(addrs)
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("Failed to find any Mauve records at %s", cname)
+	}
+	return ret, nil
+}
+
+func recordsToServices(addrs []*net.SRV) []*MauveAlertService {
+	var ret []*MauveAlertService
+	for _, srv := range addrs {
+		// A target of "." means the service definitely isn't available here
+		host := strings.TrimSuffix(srv.Target, ".")
+		if host == "" {
+			continue
+		}
+		ret = append(ret, &MauveAlertService{
+			Host:     host,
+			Port:     srv.Port,
+			Priority: srv.Priority,
+			Weight:   srv.Weight,
+		})
+	}
+	return ret
+}
+
+// Order the servers as RFC 2782 says to try them, then drop any the policy
+// says not to use.
+func selectServices(hosts []*MauveAlertService, policy SRVPolicy) []*MauveAlertService {
+	var ret []*MauveAlertService
+	for _, mas := range orderSRV(hosts) {
+		if policy == SRVLowestPriority && len(ret) > 0 && mas.Priority != ret[0].Priority {
+			break
+		}
+		ret = append(ret, mas)
+	}
+	return ret
+}
+
+// Put servers in the order RFC 2782 says to try them: lowest priority
+// first, and within each priority picked at random, with the chance of a
+// server being picked next proportional to its weight.
+func orderSRV(hosts []*MauveAlertService) []*MauveAlertService {
+	sorted := make([]*MauveAlertService, len(hosts))
+	copy(sorted, hosts)
+	sort.Stable(byPriority(sorted))
+	ret := make([]*MauveAlertService, 0, len(sorted))
+	for start := 0; start < len(sorted); {
+		end := start
+		for end < len(sorted) && sorted[end].Priority == sorted[start].Priority {
+			end++
+		}
+		ret = append(ret, weightedShuffle(sorted[start:end])...)
+		start = end
+	}
+	return ret
+}
+
+// The RFC 2782 selection, repeated until every server has been picked.
+func weightedShuffle(tier []*MauveAlertService) []*MauveAlertService {
+	// Zero-weight servers go first, so they have a small chance of being picked
+	left := make([]*MauveAlertService, 0, len(tier))
+	for _, mas := range tier {
+		if mas.Weight == 0 {
+			left = append(left, mas)
+		}
+	}
+	for _, mas := range tier {
+		if mas.Weight != 0 {
+			left = append(left, mas)
+		}
+	}
+	ret := make([]*MauveAlertService, 0, len(tier))
+	for len(left) > 0 {
+		total := 0
+		for _, mas := range left {
+			total += int(mas.Weight)
+		}
+		pick := 0
+		if total > 0 {
+			n := rand.Intn(total + 1)
+			for i, mas := range left {
+				n -= int(mas.Weight)
+				if n <= 0 {
+					pick = i
+					break
+				}
+			}
+		}
+		ret = append(ret, left[pick])
+		left = append(left[:pick], left[pick+1:]...)
+	}
+	return ret
+}
+
+type byPriority []*MauveAlertService
+
+func (a byPriority) Len() int           { return len(a) }
+func (a byPriority) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byPriority) Less(i, j int) bool { return a[i].Priority < a[j].Priority }
+
+// Parse a host:port Mauve server address, for when the server is given
+// explicitly rather than looked up.
+func ParseMauveService(hostport string) (*MauveAlertService, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Bad port in Mauve address %s: %s", hostport, err)
+	}
+	return &MauveAlertService{Host: host, Port: uint16(p)}, nil
+}
+
+// Work out which Mauve servers to send to: either the target is a host:port
+// and that's the only server, or it's a domain whose SRV records are looked up.
+func ResolveMauves(target string, policy SRVPolicy) ([]*MauveAlertService, error) {
+	return resolveMauves(target, policy, LookupMauves)
+}
+
+func resolveMauves(target string, policy SRVPolicy, lookup func(string, SRVPolicy) ([]*MauveAlertService, error)) ([]*MauveAlertService, error) {
+	if _, _, err := net.SplitHostPort(target); err == nil {
+		mas, err := ParseMauveService(target)
+		if err != nil {
+			return nil, err
+		}
+		return []*MauveAlertService{mas}, nil
+	}
+	return lookup(target, policy)
+}
+
+// A resolver which sends its queries to the given DNS server (host:port, or
+// just a host to use port 53) rather than those in /etc/resolv.conf.
+func NewDNSResolver(server string) *net.Resolver {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
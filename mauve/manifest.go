@@ -0,0 +1,199 @@
+package mauve
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTT has no way to say "these are all the alerts from a source", so to
+// replace over MQTT the publisher also publishes a retained Manifest of the
+// ids in the update to {base}/{source}/$manifest, and the receiver clears
+// any alert it knew of from that source which isn't listed.
+type Manifest struct {
+	Source           string   `json:"source"`
+	Ids              []string `json:"ids"`
+	TransmissionTime uint64   `json:"transmission_time"`
+	// When it was published, as for JSONAlert.Published
+	Published int64 `json:"published,omitempty"`
+}
+
+// The manifest for a replace update.
+func NewManifest(up *AlertUpdate) *Manifest {
+	m := &Manifest{
+		Source:           up.GetSource(),
+		Ids:              make([]string, len(up.Alert)),
+		TransmissionTime: up.GetTransmissionTime(),
+	}
+	for i, al := range up.Alert {
+		m.Ids[i] = al.GetId()
+	}
+	return m
+}
+
+func ParseManifest(payload []byte) (*Manifest, error) {
+	m := new(Manifest)
+	if err := json.Unmarshal(payload, m); err != nil {
+		return nil, err
+	}
+	if m.Source == "" {
+		return nil, ErrMissingSource
+	}
+	return m, nil
+}
+
+const manifestLevel = "$manifest"
+
+// The retained topic a source's manifest is published to.
+func (ts *TopicScheme) ManifestTopic(source string) string {
+	return fmt.Sprintf("%s/%s/%s", ts.Base, EscapeTopicLevel(source), manifestLevel)
+}
+
+// The filter to subscribe to for every source's manifest.
+func (ts *TopicScheme) ManifestFilter() string {
+	return fmt.Sprintf("%s/+/%s", ts.Base, manifestLevel)
+}
+
+// Get the source back from a manifest topic, or an error if the topic isn't
+// one.
+func (ts *TopicScheme) ParseManifestTopic(topic string) (string, error) {
+	rest := strings.TrimPrefix(topic, ts.Base+"/")
+	parts := strings.Split(rest, "/")
+	if rest == topic || len(parts) != 2 || parts[1] != manifestLevel {
+		return "", fmt.Errorf("Topic %s isn't a manifest", topic)
+	}
+	return UnescapeTopicLevel(parts[0])
+}
+
+// A ManifestTracker keeps, for each source, the ids of the alerts seen
+// since its last manifest, so that a new manifest can be turned into clears
+// for the alerts which have gone. It's safe to use from many goroutines.
+//
+// With retained alerts, a late subscriber is also sent the last raise of
+// any alert swept by a replace, so the tracker also keeps the ids in each
+// source's latest manifest and when it was published, and the retained
+// alerts seen before it, to tell which of those are left over: any
+// retained alert the manifest doesn't list which wasn't published after
+// it. Alerts which don't say when they were published (protobuf over MQTT
+// 3) are taken as being from before it.
+type ManifestTracker struct {
+	mu        sync.Mutex
+	known     map[string]map[string]bool
+	listed    map[string]map[string]bool
+	published map[string]int64
+	retained  map[string]map[string]int64
+}
+
+func NewManifestTracker() *ManifestTracker {
+	return &ManifestTracker{
+		known:     make(map[string]map[string]bool),
+		listed:    make(map[string]map[string]bool),
+		published: make(map[string]int64),
+		retained:  make(map[string]map[string]int64),
+	}
+}
+
+func addId(ids map[string]map[string]bool, source, id string) {
+	if ids[source] == nil {
+		ids[source] = make(map[string]bool)
+	}
+	ids[source][id] = true
+}
+
+// Note an alert from source.
+func (mt *ManifestTracker) Seen(source, id string) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	addId(mt.known, source, id)
+}
+
+// Note a retained alert from source, e.g. as received on subscribing, and
+// when it was published (zero if it doesn't say). It returns false if the
+// source's latest manifest doesn't list the alert and came after it, in
+// which case it was swept by a replace and should be cleared rather than
+// passed on.
+func (mt *ManifestTracker) SeenRetained(source, id string, published int64) bool {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if listed, ok := mt.listed[source]; ok && !listed[id] && published <= mt.published[source] {
+		return false
+	}
+	addId(mt.known, source, id)
+	if mt.retained[source] == nil {
+		mt.retained[source] = make(map[string]int64)
+	}
+	mt.retained[source][id] = published
+	return true
+}
+
+// Take a retained manifest, e.g. as received on subscribing, as the alerts
+// a source currently has. Alerts which have only been seen live aren't
+// cleared, but clears are returned for the retained alerts seen from the
+// source which the manifest doesn't list, and which were published before
+// it, as they were swept by the replace.
+func (mt *ManifestTracker) Baseline(m *Manifest) []*Alert {
+	_, cur := mt.swap(m)
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	var gone []string
+	for id, published := range mt.retained[m.Source] {
+		if cur[id] {
+			continue
+		}
+		if published <= m.Published {
+			gone = append(gone, id)
+		} else {
+			// Sent since the replace, so still one of the source's
+			addId(mt.known, m.Source, id)
+		}
+	}
+	delete(mt.retained, m.Source)
+	return clearAlerts(gone)
+}
+
+// Take a new manifest, returning clears for the alerts known from the
+// source which aren't in it.
+func (mt *ManifestTracker) Replace(m *Manifest) []*Alert {
+	prev, cur := mt.swap(m)
+	var gone []string
+	for id := range prev {
+		if !cur[id] {
+			gone = append(gone, id)
+		}
+	}
+	return clearAlerts(gone)
+}
+
+// Clears, as of now, for each of ids, in order.
+func clearAlerts(ids []string) []*Alert {
+	sort.Strings(ids)
+	now := uint64(time.Now().Unix())
+	clears := make([]*Alert, len(ids))
+	for i := range ids {
+		raise, clear := uint64(0), now
+		clears[i] = &Alert{Id: &ids[i], RaiseTime: &raise, ClearTime: &clear}
+	}
+	return clears
+}
+
+// Replace the known alerts from the manifest's source, returning the old
+// and new sets.
+func (mt *ManifestTracker) swap(m *Manifest) (prev, cur map[string]bool) {
+	// Separate copies, as more alerts will be added to the known ones
+	cur = make(map[string]bool, len(m.Ids))
+	listed := make(map[string]bool, len(m.Ids))
+	for _, id := range m.Ids {
+		cur[id] = true
+		listed[id] = true
+	}
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	prev = mt.known[m.Source]
+	mt.known[m.Source] = cur
+	mt.listed[m.Source] = listed
+	mt.published[m.Source] = m.Published
+	return prev, listed
+}
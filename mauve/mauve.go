@@ -3,7 +3,8 @@ package mauve
 import (
 	"fmt"
 	"math/rand"
-	"os"
+	"net"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -11,6 +12,16 @@ import (
 type MauveAlertService struct {
 	Host string
 	Port uint16
+	// From the SRV record, if the server was looked up
+	Priority uint16
+	Weight   uint16
+	// If set, this is sent to rather than looking up Host (e.g. when the
+	// server came from a ServiceCache)
+	IP net.IP `json:",omitempty"`
+}
+
+func (mas *MauveAlertService) String() string {
+	return net.JoinHostPort(mas.Host, strconv.Itoa(int(mas.Port)))
 }
 
 // Wrap a single Alert in an AlertUpdate message, with the
@@ -34,69 +45,217 @@ func randomTransmissionId() uint64 {
 	return uint64(r.Int63())
 }
 
-// This is identical to time.ParseDuration(string), however it can also take
-// the single string specifier "now" which should always return 0
-func ParseTimeWithNow(raw string) (time.Duration,error) {
-	// This parses
+// Layouts for absolute times given without a timezone, which are taken to
+// be in the local timezone.
+var localTimeLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// Parse a time, which can be any of:
+//
+//	now
+//	a duration relative to now, e.g. 10m, +1h30m, -5m
+//	a UNIX timestamp, e.g. 1792400400
+//	an RFC3339 time, e.g. 2026-10-20T09:00:00Z
+//	a local date and time, e.g. 2026-10-20T09:00, "2026-10-20 09:00" or 2026-10-20
+//	a time of day, e.g. 17:30, which is tomorrow if that's already passed today
+//	today or tomorrow, optionally with a time of day, e.g. "tomorrow 09:00"
+func ParseTime(raw string, now time.Time) (time.Time, error) {
+	raw = strings.TrimSpace(raw)
 	if raw == "" {
-		return 0,fmt.Errorf("Invalid empty time string")
-	} else if raw == "now" {
-		return 0,nil
-	} else {
-		d, err := time.ParseDuration(raw)
-		if err != nil {
-			// log.Fatalf("Failed to parse raise time: ")
-			return 0,err
-		} else {
-			return d,nil
+		return time.Time{}, fmt.Errorf("Invalid empty time string")
+	}
+	if raw == "now" {
+		return now, nil
+	}
+	if d, err := time.ParseDuration(raw); err == nil {
+		return now.Add(d), nil
+	}
+	if secs, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	for _, layout := range localTimeLayouts {
+		if t, err := time.ParseInLocation(layout, raw, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	if t, ok := parseCalendarTime(raw, now); ok {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("Can't understand time %q", raw)
+}
+
+// Parse "HH:MM[:SS]", "today", "tomorrow" or a day followed (or preceded)
+// by a time of day.
+func parseCalendarTime(raw string, now time.Time) (time.Time, bool) {
+	var day string
+	var clock time.Time
+	haveClock := false
+	for _, word := range strings.Fields(strings.ToLower(raw)) {
+		switch word {
+		case "today", "tomorrow":
+			if day != "" {
+				return time.Time{}, false
+			}
+			day = word
+		default:
+			if haveClock {
+				return time.Time{}, false
+			}
+			var err error
+			if clock, err = time.Parse("15:04", word); err != nil {
+				if clock, err = time.Parse("15:04:05", word); err != nil {
+					return time.Time{}, false
+				}
+			}
+			haveClock = true
 		}
 	}
+	y, m, d := now.Date()
+	t := time.Date(y, m, d, clock.Hour(), clock.Minute(), clock.Second(), 0, now.Location())
+	if day == "tomorrow" || (day == "" && t.Before(now)) {
+		t = time.Date(y, m, d+1, clock.Hour(), clock.Minute(), clock.Second(), 0, now.Location())
+	}
+	return t, true
+}
+
+// Parse a time as ParseTime does, but return it as a duration relative to
+// now. Plain durations come back exactly as time.ParseDuration gives them.
+func ParseTimeWithNow(raw string) (time.Duration,error) {
+	if raw == "now" {
+		return 0,nil
+	}
+	if d, err := time.ParseDuration(raw); err == nil {
+		return d,nil
+	}
+	now := time.Now()
+	t, err := ParseTime(raw, now)
+	if err != nil {
+		return 0,err
+	}
+	return t.Sub(now),nil
+}
+
+// Parse a time given to CreateAlert, which has to fit in an Alert.
+func parseAlertTime(raw string, now time.Time) (time.Time, error) {
+	t, err := ParseTime(raw, now)
+	if err != nil {
+		return t, err
+	}
+	if t.Unix() < 0 {
+		return t, fmt.Errorf("%s is before 1970", t)
+	}
+	return t, nil
+}
+
+// Named alert importances, for use with AlertOptions and the -importance
+// flag. Mauve only compares the importance of alerts from the same source,
+// so the numbers just need to be in the right order.
+const (
+	ImportanceUnspecified uint32 = 0 // leave it to the server's default
+	ImportanceLow         uint32 = 25
+	ImportanceNormal      uint32 = 50
+	ImportanceHigh        uint32 = 75
+	ImportanceUrgent      uint32 = 100
+)
+
+var importanceNames = map[string]uint32{
+	"":            ImportanceUnspecified,
+	"unspecified": ImportanceUnspecified,
+	"low":         ImportanceLow,
+	"normal":      ImportanceNormal,
+	"high":        ImportanceHigh,
+	"urgent":      ImportanceUrgent,
+}
+
+// Parse an importance, which can be one of the names low, normal, high or
+// urgent, or just a number.
+func ParseImportance(raw string) (uint32, error) {
+	if imp, ok := importanceNames[strings.ToLower(strings.TrimSpace(raw))]; ok {
+		return imp, nil
+	}
+	imp, err := strconv.ParseUint(raw, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Unknown importance %q, should be low, normal, high, urgent or a number", raw)
+	}
+	return uint32(imp), nil
+}
+
+// Everything needed to make an Alert with CreateAlertWithOptions. The times
+// are in any format ParseTime accepts, and are left unset if empty.
+type AlertOptions struct {
+	Id         string
+	Raise      string
+	Clear      string
+	Subject    string // defaults to the hostname
+	Summary    string
+	Detail     string
+	Suppress   string
+	Importance uint32 // one of the Importance constants, or any other number
 }
 
 func CreateAlert(id string, raise string, clear string, subject string, summary string, detail string, suppress string) (*Alert,error) {
-	var tRaise, tClear, tSuppress uint64
-	if raise != "" {
-		tDiff,err := ParseTimeWithNow(raise)
+	return CreateAlertWithOptions(AlertOptions{
+		Id:       id,
+		Raise:    raise,
+		Clear:    clear,
+		Subject:  subject,
+		Summary:  summary,
+		Detail:   detail,
+		Suppress: suppress,
+	})
+}
+
+// Make an Alert from string options, such as those given on the command
+// line, using NewAlert.
+func CreateAlertWithOptions(opts AlertOptions) (*Alert,error) {
+	now := time.Now()
+	alertOpts := []AlertOption{WithImportance(opts.Importance)}
+	if opts.Raise != "" {
+		t, err := parseAlertTime(opts.Raise, now)
 		if err != nil {
 			return nil,fmt.Errorf("Problem with raise time: %s", err)
 		}
-		tRaise = uint64(time.Now().Add(tDiff).Unix())
+		alertOpts = append(alertOpts, RaiseAt(t))
 	}
-	if clear != "" {
-		tDiff,err := ParseTimeWithNow(clear)
+	if opts.Clear != "" {
+		t, err := parseAlertTime(opts.Clear, now)
 		if err != nil {
 			return nil,fmt.Errorf("Problem with clear time: %s", err)
 		}
-		tClear = uint64(time.Now().Add(tDiff).Unix())
+		alertOpts = append(alertOpts, ClearAt(t))
 	}
-	if suppress != "" {
-		tDiff,err := ParseTimeWithNow(suppress)
+	if opts.Suppress != "" {
+		t, err := parseAlertTime(opts.Suppress, now)
 		if err != nil {
 			return nil,fmt.Errorf("Problem with suppress time: %s", err)
 		}
-		tSuppress = uint64(time.Now().Add(tDiff).Unix())
-	}
-	alert := Alert{
-		Id:            &id,
-		RaiseTime:     &tRaise,
-		ClearTime:     &tClear,
-		SuppressUntil: &tSuppress,
+		alertOpts = append(alertOpts, SuppressUntil(t))
 	}
-	if subject != "" {
-		alert.Subject = &subject
-	} else {
-		hn, _ := os.Hostname()
-		alert.Subject = &hn
+	if opts.Subject != "" {
+		alertOpts = append(alertOpts, WithSubject(opts.Subject))
 	}
-	if summary != "" {
-		alert.Summary = &summary
+	if opts.Summary != "" {
+		alertOpts = append(alertOpts, WithSummary(opts.Summary))
 	}
-	if detail != "" {
-		alert.Detail = &detail
+	if opts.Detail != "" {
+		alertOpts = append(alertOpts, WithDetail(opts.Detail))
 	}
-	return &alert,nil
+	return NewAlert(opts.Id, alertOpts...),nil
 }
 
+// The topic (below the base topic) of an alert in the legacy layout, with
+// slashes replaced by underscores.
+//
+// Deprecated: use TopicScheme, which follows the layout in README-MQTT.md
+// and escapes reversibly.
 func AlertTopic(al *Alert, source string) string {
 	esource := strings.Replace(source, "/", "_", -1)
 	esubj := strings.Replace(*al.Subject, "/", "_", -1)
@@ -107,6 +266,8 @@ func AlertTopic(al *Alert, source string) string {
 // So topic is the full topic of the MQTT message, including the "baseTopic" which is what we're
 // subscribed to, so for example:
 // govealert/foo/bar/baz => foo
+//
+// Deprecated: use TopicScheme.Parse.
 func ParseAlertTopic(baseTopic string, topic string) (source string, subject string, id string, err error) {
 	lBase := len(strings.Split(baseTopic, "/")) // todo: deal with leading/trailing slashes
 	parts := strings.SplitN(topic, "/", lBase+3)
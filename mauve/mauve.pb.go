@@ -139,8 +139,8 @@ type AlertUpdate struct {
 	// Alert data follows
 	//
 	Alert []*Alert `protobuf:"bytes,4,rep,name=alert" json:"alert,omitempty"`
-	// Signature to authenticate this data - no scheme defined currently, maybe
-	// SHA1(alert.raw + password) ?
+	// Signature to authenticate this data, if the sender and receiver share a
+	// secret: HMAC-SHA256(secret, AlertUpdate marshalled without signature).
 	//
 	Signature []byte `protobuf:"bytes,5,opt,name=signature" json:"signature,omitempty"`
 	// The UNIX time at which the packet was sent by the server.
@@ -1,8 +1,25 @@
 package mauve
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"code.google.com/p/goprotobuf/proto"
 )
 
 func TestCreateAlert(t *testing.T) {
@@ -16,7 +33,7 @@ func TestCreateAlert(t *testing.T) {
 	suppress := ""
 	a,err := CreateAlert(testId,testRaiseTime,testClearTime,subject,summary,detail,suppress)
 	if err != nil {
-		t.Fatal("Alert creation failed: %s", err)
+		t.Fatalf("Alert creation failed: %s", err)
 	}
 	if *a.Id != testId {
 		t.Errorf("Created alert ID didn't match")
@@ -29,7 +46,7 @@ func TestCreateUpdate(t *testing.T) {
 	replace := false
 	fakeAlert,err := CreateAlert("id","now","","","","","")
 	if err != nil {
-		t.Fatal("Alert created with error: %s", err)
+		t.Fatalf("Alert created with error: %s", err)
 	}
 	u := CreateUpdate(sourceTest, replace, fakeAlert)
 	if *u.Source != sourceTest {
@@ -72,7 +89,7 @@ func TestAlertTopic(t *testing.T) {
 	for tass, expt := range testCases {
 		tAlert,err := CreateAlert(tass.Id, "", "", tass.Subject, "", "", "")
 		if err != nil {
-			t.Fatal("Failed to create alert: %s", err)
+			t.Fatalf("Failed to create alert: %s", err)
 		}
 		xret := AlertTopic(tAlert, tass.Source)
 		if xret != expt {
@@ -96,7 +113,7 @@ func TestParseAlertTopic(t *testing.T) {
 			}
 		} else {
 			if expected != nil { // if expected is nil then we're expecting an error
-				t.Fatal("Error returned from %s", testTopic)
+				t.Fatalf("Error returned from %s", testTopic)
 			}
 		}
 	}
@@ -112,4 +129,823 @@ func SlicesEqual(sliceA []string, sliceB []string) bool {
 		}
 	}
 	return true
-}
\ No newline at end of file
+}
+func TestAlertBatch(t *testing.T) {
+	b := &alertBatch{}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			al, _ := CreateAlert("id", "now", "", "", "", "", "")
+			b.add(al)
+		}()
+	}
+	wg.Wait()
+	if taken := b.take(); len(taken) != 50 {
+		t.Errorf("Expected 50 batched alerts, got %d", len(taken))
+	}
+	if taken := b.take(); len(taken) != 0 {
+		t.Errorf("Batch wasn't emptied by take, still has %d alerts", len(taken))
+	}
+	first, _ := CreateAlert("first", "now", "", "", "", "", "")
+	second, _ := CreateAlert("second", "now", "", "", "", "", "")
+	b.add(second)
+	b.putBack([]*Alert{first})
+	taken := b.take()
+	if len(taken) != 2 || *taken[0].Id != "first" || *taken[1].Id != "second" {
+		t.Errorf("Alerts put back should come before newer ones, got %v", taken)
+	}
+}
+
+func TestSignUpdate(t *testing.T) {
+	secret := []byte("sekrit")
+	al, _ := CreateAlert("id", "now", "", "", "", "", "")
+	up := CreateUpdate("test.example.com", false, al)
+	if err := VerifyUpdate(up, secret); err != ErrNoSignature {
+		t.Errorf("Unsigned update should give ErrNoSignature, got %v", err)
+	}
+	if err := SignUpdate(up, secret); err != nil {
+		t.Fatalf("Failed to sign update: %s", err)
+	}
+	if err := VerifyUpdate(up, secret); err != nil {
+		t.Errorf("Signed update didn't verify: %s", err)
+	}
+	if err := VerifyUpdate(up, []byte("wrong")); err != ErrBadSignature {
+		t.Errorf("Update verified with the wrong secret, got %v", err)
+	}
+	// Signing again shouldn't include the old signature
+	if err := SignUpdate(up, secret); err != nil || VerifyUpdate(up, secret) != nil {
+		t.Errorf("Re-signed update didn't verify")
+	}
+	clear := uint64(1)
+	up.Alert[0].ClearTime = &clear
+	if err := VerifyUpdate(up, secret); err != ErrBadSignature {
+		t.Errorf("Tampered update still verified, got %v", err)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	loc := time.FixedZone("test", 3600)
+	now := time.Date(2026, 10, 18, 15, 0, 0, 0, loc)
+	testCases := map[string]time.Time{
+		"now":                       now,
+		"10m":                       now.Add(10 * time.Minute),
+		"+1h30m":                    now.Add(90 * time.Minute),
+		"-5m":                       now.Add(-5 * time.Minute),
+		"1792400400":                time.Unix(1792400400, 0),
+		"2026-10-20T09:00:00Z":      time.Date(2026, 10, 20, 9, 0, 0, 0, time.UTC),
+		"2026-10-20T09:00:00+02:00": time.Date(2026, 10, 20, 7, 0, 0, 0, time.UTC),
+		"2026-10-20T09:00":          time.Date(2026, 10, 20, 9, 0, 0, 0, loc),
+		"2026-10-20 09:00:30":       time.Date(2026, 10, 20, 9, 0, 30, 0, loc),
+		"2026-10-20":                time.Date(2026, 10, 20, 0, 0, 0, 0, loc),
+		"17:30":                     time.Date(2026, 10, 18, 17, 30, 0, 0, loc),
+		"09:00":                     time.Date(2026, 10, 19, 9, 0, 0, 0, loc), // already passed, so tomorrow
+		"9:00":                      time.Date(2026, 10, 19, 9, 0, 0, 0, loc),
+		"today 09:00":               time.Date(2026, 10, 18, 9, 0, 0, 0, loc), // explicitly today, even though it's passed
+		"17:30 today":               time.Date(2026, 10, 18, 17, 30, 0, 0, loc),
+		"tomorrow 09:00":            time.Date(2026, 10, 19, 9, 0, 0, 0, loc),
+		"tomorrow":                  time.Date(2026, 10, 19, 0, 0, 0, 0, loc),
+		"Tomorrow 23:59:59":         time.Date(2026, 10, 19, 23, 59, 59, 0, loc),
+	}
+	for raw, expected := range testCases {
+		res, err := ParseTime(raw, now)
+		if err != nil {
+			t.Errorf("Failed to parse time [%s]: %s", raw, err)
+		} else if !res.Equal(expected) {
+			t.Errorf("%s does not match %s for test [%s]", res, expected, raw)
+		}
+	}
+	for _, bad := range []string{"", "never", "25:00", "today tomorrow", "09:00 10:00", "2026-13-01"} {
+		if res, err := ParseTime(bad, now); err == nil {
+			t.Errorf("Expected an error parsing [%s], got %s", bad, res)
+		}
+	}
+}
+
+func TestCreateAlertTimes(t *testing.T) {
+	a, err := CreateAlert("id", "1792400400", "2026-10-20T10:00:00Z", "", "", "", "1792400400")
+	if err != nil {
+		t.Fatalf("Alert creation failed: %s", err)
+	}
+	if *a.RaiseTime != 1792400400 || *a.SuppressUntil != 1792400400 {
+		t.Errorf("Raise/suppress times weren't taken as UNIX times: %v", a)
+	}
+	if *a.ClearTime != uint64(time.Date(2026, 10, 20, 10, 0, 0, 0, time.UTC).Unix()) {
+		t.Errorf("Clear time wasn't parsed as RFC3339: %v", a)
+	}
+	if _, err := CreateAlert("id", "-5", "", "", "", "", ""); err == nil {
+		t.Errorf("A raise time before 1970 should be an error")
+	}
+}
+
+func TestParseImportance(t *testing.T) {
+	testCases := map[string]uint32{
+		"":       ImportanceUnspecified,
+		"low":    ImportanceLow,
+		"Normal": ImportanceNormal,
+		"high":   ImportanceHigh,
+		"URGENT": ImportanceUrgent,
+		"42":     42,
+	}
+	for raw, expected := range testCases {
+		imp, err := ParseImportance(raw)
+		if err != nil {
+			t.Errorf("Failed to parse importance [%s]: %s", raw, err)
+		} else if imp != expected {
+			t.Errorf("%d does not match %d for test [%s]", imp, expected, raw)
+		}
+	}
+	if _, err := ParseImportance("critical"); err == nil {
+		t.Errorf("Expected an error for an unknown importance name")
+	}
+}
+
+func TestCreateAlertWithOptions(t *testing.T) {
+	a, err := CreateAlertWithOptions(AlertOptions{Id: "id", Raise: "now", Subject: "subject.example.com", Importance: ImportanceHigh})
+	if err != nil {
+		t.Fatalf("Alert creation failed: %s", err)
+	}
+	if a.GetImportance() != ImportanceHigh || a.GetSubject() != "subject.example.com" {
+		t.Errorf("Options weren't set on the alert: %v", a)
+	}
+	a, err = CreateAlertWithOptions(AlertOptions{Id: "id"})
+	if err != nil {
+		t.Fatalf("Alert creation failed: %s", err)
+	}
+	if a.Importance != nil {
+		t.Errorf("Unspecified importance shouldn't be sent, got %d", a.GetImportance())
+	}
+}
+
+func TestNewAlert(t *testing.T) {
+	raise := time.Date(2026, 10, 20, 9, 0, 0, 0, time.UTC)
+	before := time.Now()
+	a := NewAlert("backup",
+		WithSubject("db1.example.com"),
+		WithSummary("backup failed"),
+		RaiseAt(raise),
+		ClearAfter(time.Hour),
+		SuppressFor(0),
+		WithImportance(ImportanceUrgent),
+	)
+	if a.GetId() != "backup" || a.GetSubject() != "db1.example.com" || a.GetSummary() != "backup failed" {
+		t.Errorf("Strings weren't set on the alert: %v", a)
+	}
+	if a.GetRaiseTime() != uint64(raise.Unix()) {
+		t.Errorf("Raise time %d should be %d", a.GetRaiseTime(), raise.Unix())
+	}
+	if c := int64(a.GetClearTime()); c < before.Add(time.Hour).Unix() || c > time.Now().Add(time.Hour).Unix() {
+		t.Errorf("Clear time %d isn't an hour from now", c)
+	}
+	if s := int64(a.GetSuppressUntil()); s < before.Unix() || s > time.Now().Unix() {
+		t.Errorf("Suppress time %d isn't now", s)
+	}
+	if a.GetImportance() != ImportanceUrgent {
+		t.Errorf("Importance wasn't set")
+	}
+	// The same alert through the string wrapper
+	b, err := CreateAlert("backup", raise.Format(time.RFC3339), "", "db1.example.com", "backup failed", "", "")
+	if err != nil {
+		t.Fatalf("Alert creation failed: %s", err)
+	}
+	if b.GetRaiseTime() != a.GetRaiseTime() || b.GetClearTime() != 0 || b.Importance != nil {
+		t.Errorf("CreateAlert didn't match NewAlert: %v", b)
+	}
+	if NewAlert("id", RaiseAt(time.Time{})).GetRaiseTime() != 0 {
+		t.Errorf("A zero time should leave the raise time unset")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Now()
+	testCases := map[*Alert]error{
+		NewAlert("ok", RaiseAfter(0)):                                     nil,
+		NewAlert("heartbeat", RaiseAfter(10*time.Minute), ClearAfter(0)): nil,
+		NewAlert("", RaiseAfter(0)):                                       ErrMissingId,
+		NewAlert("long", WithSummary(strings.Repeat("x", 101))):           ErrSummaryTooLong,
+		NewAlert("long", WithSummary(strings.Repeat("é", 100))):           nil,
+		NewAlert("backwards", RaiseAt(now), ClearAt(now.Add(-time.Hour))): ErrClearBeforeRaise,
+	}
+	for al, expected := range testCases {
+		err := al.Validate()
+		if expected == nil {
+			if err != nil {
+				t.Errorf("Alert %s should be valid, got %s", al.GetId(), err)
+			}
+			continue
+		}
+		ve, ok := err.(*ValidationError)
+		if !ok || ve.Err != expected {
+			t.Errorf("Alert %s should fail with %s, got %v", al.GetId(), expected, err)
+		}
+	}
+	up := CreateUpdate("", false, NewAlert("ok"))
+	if ve, ok := up.Validate().(*ValidationError); !ok || ve.Err != ErrMissingSource {
+		t.Errorf("Update without a source should be invalid")
+	}
+	up = CreateUpdate("test.example.com", false, NewAlert("ok"), NewAlert(""))
+	if ve, ok := up.Validate().(*ValidationError); !ok || ve.Err != ErrMissingId {
+		t.Errorf("Update with an invalid alert should be invalid")
+	}
+	up = CreateUpdate("test.example.com", false, NewAlert("ok"))
+	if err := up.Validate(); err != nil {
+		t.Errorf("Update should be valid, got %s", err)
+	}
+}
+
+func TestStrictBatch(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	pbc := &ProtobufClient{
+		Hosts:  []*MauveAlertService{{Host: "127.0.0.1", Port: uint16(addr.Port)}},
+		Source: "test",
+		Strict: true,
+	}
+	pbc.AddBatchedAlert(NewAlert("", RaiseAfter(0)))
+	if _, ok := pbc.SendBatchedAlerts(false).(*ValidationError); !ok {
+		t.Fatalf("Expected an invalid alert to be refused")
+	}
+	// The invalid alert shouldn't have been put back to block this one
+	pbc.AddBatchedAlert(NewAlert("ok", RaiseAfter(0)))
+	if err := pbc.SendBatchedAlerts(false); err != nil {
+		t.Fatalf("Failed to send a valid alert after an invalid one: %s", err)
+	}
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := new(AlertUpdate)
+	if err := proto.Unmarshal(buf[:n], up); err != nil {
+		t.Fatal(err)
+	}
+	if len(up.Alert) != 1 || up.Alert[0].GetId() != "ok" {
+		t.Errorf("Expected just the valid alert to be sent, got %v", up.Alert)
+	}
+	if taken := pbc.batch.take(); len(taken) != 0 {
+		t.Errorf("Batch should be empty, has %v", taken)
+	}
+}
+
+// A Sender which records what it's sent, or fails if fail is set.
+type testSender struct {
+	fail error
+	sent []*AlertUpdate
+}
+
+func (ts *testSender) AddBatchedAlert(alert *Alert)          {}
+func (ts *testSender) SendBatchedAlerts(replace bool) error { return nil }
+func (ts *testSender) Flush(ctx context.Context) error      { return nil }
+func (ts *testSender) Close() error                         { return nil }
+func (ts *testSender) Send(ctx context.Context, up *AlertUpdate) error {
+	if ts.fail != nil {
+		return ts.fail
+	}
+	ts.sent = append(ts.sent, up)
+	return nil
+}
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "govealert-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sp, err := OpenSpool(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := &testSender{fail: &SendError{Failed: []*HostError{{&MauveAlertService{Host: "mauve", Port: 32741}, StageWrite, errors.New("down")}}}}
+	ctx := context.Background()
+	err = sp.SendOrSpool(ctx, sender, CreateUpdate("test", false, NewAlert("first", RaiseAfter(0))))
+	if _, ok := err.(*SpooledError); !ok {
+		t.Fatalf("Expected the update to be spooled, got %v", err)
+	}
+	// An old update, whose raise should be dropped but clear kept
+	stale := CreateUpdate("test", false, NewAlert("raise", RaiseAfter(0)), NewAlert("clear", ClearAfter(0)))
+	then := uint64(time.Now().Add(-2 * time.Hour).Unix())
+	stale.TransmissionTime = &then
+	if _, err := sp.Put(stale); err != nil {
+		t.Fatal(err)
+	}
+	// Something that's too old and has nothing worth sending
+	staleRaise := CreateUpdate("test", false, NewAlert("raise", RaiseAfter(0)))
+	staleRaise.TransmissionTime = &then
+	if _, err := sp.Put(staleRaise); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := sp.Flush(ctx, sender); n != 0 || err == nil {
+		t.Errorf("Flush should fail while the sender does, sent %d", n)
+	}
+	if entries, _ := sp.Entries(); len(entries) != 3 {
+		t.Errorf("Expected 3 spooled updates, got %d", len(entries))
+	}
+	sender.fail = nil
+	n, err := sp.Flush(ctx, sender)
+	if err != nil {
+		t.Fatalf("Failed to flush spool: %s", err)
+	}
+	if n != 2 || len(sender.sent) != 2 {
+		t.Fatalf("Expected 2 updates to be resent, got %d", n)
+	}
+	if sender.sent[0].Alert[0].GetId() != "first" {
+		t.Errorf("Spooled updates weren't sent in order")
+	}
+	if len(sender.sent[1].Alert) != 1 || sender.sent[1].Alert[0].GetId() != "clear" {
+		t.Errorf("Stale update should only have had its clear resent, got %v", sender.sent[1])
+	}
+	if entries, _ := sp.Entries(); len(entries) != 0 {
+		t.Errorf("Spool should be empty after flushing, has %d", len(entries))
+	}
+}
+
+// The services the policy picks from the SRV records, as LookupMauvesWith
+// would give them.
+func srvToServices(addrs []*net.SRV, policy SRVPolicy) []*MauveAlertService {
+	return selectServices(recordsToServices(addrs), policy)
+}
+
+func TestSRVPolicies(t *testing.T) {
+	addrs := []*net.SRV{
+		{Target: "backup.example.com.", Port: 32741, Priority: 20, Weight: 0},
+		{Target: "a.example.com.", Port: 32741, Priority: 10, Weight: 50},
+		{Target: ".", Port: 32741, Priority: 10, Weight: 0},
+		{Target: "b.example.com.", Port: 32742, Priority: 10, Weight: 50},
+	}
+	all := srvToServices(addrs, SRVAll)
+	if len(all) != 3 {
+		t.Fatalf("Expected 3 servers, got %d", len(all))
+	}
+	if all[2].Host != "backup.example.com" {
+		t.Errorf("Higher priority number should come last, got %s", all[2])
+	}
+	lowest := srvToServices(addrs, SRVLowestPriority)
+	if len(lowest) != 2 {
+		t.Fatalf("Expected 2 servers in the lowest priority, got %d", len(lowest))
+	}
+	for _, mas := range lowest {
+		if mas.Priority != 10 || strings.HasSuffix(mas.Host, ".") {
+			t.Errorf("Unexpected server %s", mas)
+		}
+	}
+	// With enough tries, both equally weighted servers should come first sometimes
+	firsts := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		firsts[srvToServices(addrs, SRVWeighted)[0].Host] = true
+	}
+	if !firsts["a.example.com"] || !firsts["b.example.com"] || len(firsts) != 2 {
+		t.Errorf("Weighted order isn't choosing from the lowest priority at random: %v", firsts)
+	}
+}
+
+func TestResolveMauvesStatic(t *testing.T) {
+	hosts, err := ResolveMauves("mauve.example.com:32741", SRVAll)
+	if err != nil {
+		t.Fatalf("Failed to parse static Mauve address: %s", err)
+	}
+	if len(hosts) != 1 || hosts[0].Host != "mauve.example.com" || hosts[0].Port != 32741 {
+		t.Errorf("Static address parsed wrongly: %v", hosts)
+	}
+	if hosts, err := ResolveMauves("[::1]:32741", SRVAll); err != nil || hosts[0].Host != "::1" {
+		t.Errorf("Failed to parse IPv6 Mauve address: %v %v", hosts, err)
+	}
+	if _, err := ParseMauveService("mauve.example.com:notaport"); err == nil {
+		t.Errorf("Expected an error for a bad port")
+	}
+}
+
+func TestServiceCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "govealert-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sc := &ServiceCache{Path: dir + "/cache/mauve.json", TTL: time.Minute}
+	cached := map[string]*cacheEntry{
+		"example.com": {
+			Hosts: []*MauveAlertService{
+				{Host: "a.example.com", Port: 32741, Priority: 10, IP: net.ParseIP("192.0.2.1")},
+				{Host: "b.example.com", Port: 32741, Priority: 20},
+			},
+			Expires: time.Now().Add(time.Minute),
+		},
+	}
+	if err := sc.save(cached); err != nil {
+		t.Fatalf("Failed to save cache: %s", err)
+	}
+	hosts, err := sc.LookupMauves("example.com", SRVLowestPriority)
+	if err != nil {
+		t.Fatalf("Cached lookup failed: %s", err)
+	}
+	if len(hosts) != 1 || hosts[0].Host != "a.example.com" || !hosts[0].IP.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("Cached servers didn't come back with the policy applied: %v", hosts)
+	}
+}
+
+func TestStaticResolver(t *testing.T) {
+	sr, err := ParseStaticResolver(strings.NewReader(`
+# Mauve servers for example.com
+example.com   mauve1.example.com       10 50
+Example.com.  mauve2.example.com:999   20
+192.0.2.1     mauve1.example.com  mauve1
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse static resolver: %s", err)
+	}
+	pbc, err := CreateProtobufClient("test", "example.com", WithResolver(sr), WithSRVPolicy(SRVAll))
+	if err != nil {
+		t.Fatalf("Failed to look up Mauves with a static resolver: %s", err)
+	}
+	if len(pbc.Hosts) != 2 || pbc.Hosts[0].String() != "mauve1.example.com:32741" || pbc.Hosts[1].String() != "mauve2.example.com:999" {
+		t.Errorf("Static resolver gave the wrong servers: %v", pbc.Hosts)
+	}
+	if pbc.Hosts[0].Weight != 50 || pbc.Hosts[1].Priority != 20 {
+		t.Errorf("Static resolver lost the priority or weight: %+v %+v", pbc.Hosts[0], pbc.Hosts[1])
+	}
+	if ips, err := sr.LookupIPAddr(context.Background(), "MAUVE1"); err != nil || !ips[0].IP.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("Static resolver gave the wrong address: %v %v", ips, err)
+	}
+	if _, err := LookupMauvesWith(sr, "example.org", SRVAll); err == nil {
+		t.Errorf("Expected an error for a domain not in the file")
+	}
+	for _, bad := range []string{"example.com", "example.com mauve 10 50 7", "example.com mauve high"} {
+		if _, err := ParseStaticResolver(strings.NewReader(bad)); err == nil {
+			t.Errorf("Expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestServiceCacheStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "govealert-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sr, err := ParseStaticResolver(strings.NewReader("example.com mauve.example.com\n192.0.2.1 mauve.example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := &ServiceCache{Path: dir + "/mauve.json", TTL: -time.Minute}
+	hosts, err := sc.LookupMauvesWith(sr, "example.com", SRVAll)
+	if err != nil || len(hosts) != 1 || !hosts[0].IP.Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("Lookup through the cache failed: %v %v", hosts, err)
+	}
+	// The entry has already expired, but should still be used while DNS is down
+	hosts, err = sc.LookupMauvesWith(&StaticResolver{}, "example.com", SRVAll)
+	if err != nil || len(hosts) != 1 || hosts[0].Host != "mauve.example.com" {
+		t.Errorf("Stale cache entry wasn't used when the lookup failed: %v %v", hosts, err)
+	}
+	sc.MaxStale = time.Nanosecond
+	if _, err := sc.LookupMauvesWith(&StaticResolver{}, "example.com", SRVAll); err == nil {
+		t.Errorf("Expected a cache entry past MaxStale not to be used")
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "govealert-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "govealert test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := dir+"/cert.pem", dir+"/key.pem"
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	conf, err := NewTLSConfig(certFile, certFile, keyFile, "broker.example.com")
+	if err != nil {
+		t.Fatalf("Failed to build TLS config: %s", err)
+	}
+	if conf.RootCAs == nil || len(conf.Certificates) != 1 || conf.ServerName != "broker.example.com" {
+		t.Errorf("TLS config is missing something: %+v", conf)
+	}
+	if _, err := NewTLSConfig("", certFile, "", ""); err == nil {
+		t.Errorf("Expected an error for a certificate without a key")
+	}
+	if _, err := NewTLSConfig(keyFile, "", "", ""); err == nil {
+		t.Errorf("Expected an error for a CA bundle with no certificates")
+	}
+	if err := CheckTLSBroker("ssl://broker.example.com:8883", conf); err != nil {
+		t.Errorf("ssl:// broker refused: %s", err)
+	}
+	if err := CheckTLSBroker("tcp://broker.example.com:1883", conf); err == nil {
+		t.Errorf("Expected an error using TLS with a tcp:// broker")
+	}
+	if err := CheckTLSBroker("tcp://broker.example.com:1883", nil); err != nil {
+		t.Errorf("Plain broker without TLS refused: %s", err)
+	}
+}
+
+func TestReadMQTTPassword(t *testing.T) {
+	f, err := ioutil.TempFile("", "govealert-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("s3cret\n")
+	f.Close()
+	if pw, err := ReadMQTTPassword(f.Name()); err != nil || pw != "s3cret" {
+		t.Errorf("Password file read wrongly: %q %v", pw, err)
+	}
+	old := os.Getenv(MQTTPasswordEnv)
+	defer os.Setenv(MQTTPasswordEnv, old)
+	os.Setenv(MQTTPasswordEnv, "fromenv")
+	if pw, err := ReadMQTTPassword(""); err != nil || pw != "fromenv" {
+		t.Errorf("Password not taken from the environment: %q %v", pw, err)
+	}
+	if _, err := ReadMQTTPassword(f.Name() + ".missing"); err == nil {
+		t.Errorf("Expected an error for a missing password file")
+	}
+}
+
+func TestSpoolPartialPublish(t *testing.T) {
+	dir, err := ioutil.TempDir("", "govealert-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sp, err := OpenSpool(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pe := &PublishError{Failed: []*AlertError{{"b", "govealert/test/b", errors.New("timeout")}}, Published: 1}
+	if !strings.Contains(pe.Error(), "1 of 2") {
+		t.Errorf("PublishError doesn't say how many failed: %s", pe)
+	}
+	sender := &testSender{fail: pe}
+	err = sp.SendOrSpool(context.Background(), sender, CreateUpdate("test", false, NewAlert("a"), NewAlert("b")))
+	if _, ok := err.(*SpooledError); !ok {
+		t.Fatalf("Expected the failed alert to be spooled, got %v", err)
+	}
+	sender.fail = nil
+	if n, err := sp.Flush(context.Background(), sender); err != nil || n != 1 {
+		t.Fatalf("Failed to flush spool: %d %v", n, err)
+	}
+	if al := sender.sent[0].Alert; len(al) != 1 || al[0].GetId() != "b" {
+		t.Errorf("Expected only the failed alert to be resent, got %v", al)
+	}
+}
+
+func TestEscapeTopicLevel(t *testing.T) {
+	for _, raw := range []string{"plain", "a/b", "+#", "100%", "%2F", "a%2Fb/c+d#e", "", "$SYS"} {
+		esc := EscapeTopicLevel(raw)
+		if strings.ContainsAny(esc, "/+#") {
+			t.Errorf("Escaped %q still has topic separators or wildcards: %q", raw, esc)
+		}
+		if back, err := UnescapeTopicLevel(esc); err != nil || back != raw {
+			t.Errorf("%q didn't round-trip: %q -> %q (%v)", raw, esc, back, err)
+		}
+	}
+	if _, err := UnescapeTopicLevel("bad%zz"); err == nil {
+		t.Errorf("Expected an error for bad escaping")
+	}
+}
+
+func TestTopicScheme(t *testing.T) {
+	al := NewAlert("disk/sda1", WithSubject("db1.example.com"))
+	for template, want := range map[string]string{
+		"v1":                             "govealert/site/db1.example.com/web%2F1/disk%2Fsda1",
+		"legacy":                         "govealert/site/web%2F1/db1.example.com/disk%2Fsda1",
+		"{source}/alerts/{id}/{subject}": "web%2F1/alerts/disk%2Fsda1/db1.example.com",
+	} {
+		ts, err := NewTopicScheme("govealert/site", template)
+		if err != nil {
+			t.Fatalf("Failed to make topic scheme %s: %s", template, err)
+		}
+		topic := ts.Topic("web/1", al)
+		if topic != want {
+			t.Errorf("Topic for %s is %s, should be %s", template, topic, want)
+		}
+		source, subject, id, err := ts.Parse(topic)
+		if err != nil || source != "web/1" || subject != "db1.example.com" || id != "disk/sda1" {
+			t.Errorf("Topic %s didn't parse back: %q %q %q %v", topic, source, subject, id, err)
+		}
+	}
+	ts, _ := NewTopicScheme("govealert", "v1")
+	if filter := ts.Filter(); filter != "govealert/+/+/+" {
+		t.Errorf("Wrong subscription filter: %s", filter)
+	}
+	for _, bad := range []string{"govealert/a/b", "other/a/b/c", "govealert/a/b/c/d"} {
+		if _, _, _, err := ts.Parse(bad); err == nil {
+			t.Errorf("Expected an error parsing %s", bad)
+		}
+	}
+	for _, bad := range []string{"{base}/{subject}/{id}", "{base}/{subject}/{source}/{id}/{id}", "{base}/x{subject}/{source}/{id}", "{base}/+/{subject}/{source}/{id}"} {
+		if _, err := NewTopicScheme("govealert", bad); err == nil {
+			t.Errorf("Expected an error for the template %s", bad)
+		}
+	}
+}
+
+func TestAlertJSON(t *testing.T) {
+	al := NewAlert("disk", WithSubject("db1"), WithSummary("Disk full"), WithImportance(ImportanceHigh), RaiseAt(time.Unix(1500000000, 0)))
+	raw, err := MarshalAlertJSON("web1", al)
+	if err != nil {
+		t.Fatalf("Failed to marshal alert as JSON: %s", err)
+	}
+	if !strings.Contains(string(raw), `"raise_time_rfc3339":"2017-07-14T02:40:00Z"`) || strings.Contains(string(raw), "clear_time_rfc3339") {
+		t.Errorf("JSON times aren't right: %s", raw)
+	}
+	source, back, err := UnmarshalMQTTAlert(raw)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal JSON alert: %s", err)
+	}
+	if source != "web1" || !proto.Equal(al, back) {
+		t.Errorf("JSON alert didn't round-trip: %s %v != %v", source, back, al)
+	}
+	// Just the RFC 3339 time will do
+	_, back, err = UnmarshalMQTTAlert([]byte(`{"id": "x", "clear_time_rfc3339": "2017-07-14T03:40:00+01:00"}`))
+	if err != nil || back.GetClearTime() != 1500000000 || back.GetRaiseTime() != 0 {
+		t.Errorf("RFC 3339 time parsed wrongly: %v %v", back, err)
+	}
+	if _, _, err := UnmarshalMQTTAlert([]byte(`{"summary": "no id"}`)); err != ErrMissingId {
+		t.Errorf("Expected ErrMissingId, got %v", err)
+	}
+	if JSONPublished(raw) != 0 {
+		t.Errorf("MarshalAlertJSON shouldn't say when it was published")
+	}
+	raw, _ = marshalMQTTAlert(EncodingJSON, "web1", al, 1500000000123)
+	if JSONPublished(raw) != 1500000000123 {
+		t.Errorf("Published time not given: %s", raw)
+	}
+	// And protobuf still works
+	pkt, _ := proto.Marshal(al)
+	if JSONPublished(pkt) != 0 {
+		t.Errorf("A protobuf alert can't say when it was published")
+	}
+	if _, back, err := UnmarshalMQTTAlert(pkt); err != nil || !proto.Equal(al, back) {
+		t.Errorf("Protobuf alert didn't round-trip: %v %v", back, err)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	ts, _ := NewTopicScheme("govealert", "v1")
+	topic := ts.ManifestTopic("web/1")
+	if topic != "govealert/web%2F1/$manifest" {
+		t.Errorf("Wrong manifest topic: %s", topic)
+	}
+	if source, err := ts.ParseManifestTopic(topic); err != nil || source != "web/1" {
+		t.Errorf("Manifest topic didn't parse back: %q %v", source, err)
+	}
+	for _, bad := range []string{"govealert/web1/$heartbeat", "govealert/a/b/c", "other/web1/$manifest"} {
+		if _, err := ts.ParseManifestTopic(bad); err == nil {
+			t.Errorf("Expected %s not to be a manifest topic", bad)
+		}
+	}
+
+	mt := NewManifestTracker()
+	// Retained from before, so nothing to clear
+	mt.Baseline(NewManifest(CreateUpdate("web1", true, NewAlert("a"), NewAlert("b"))))
+	mt.Seen("web1", "c")
+	mt.Seen("web2", "a")
+	raw, _ := json.Marshal(NewManifest(CreateUpdate("web1", true, NewAlert("b"))))
+	m, err := ParseManifest(raw)
+	if err != nil {
+		t.Fatalf("Failed to parse manifest: %s", err)
+	}
+	clears := mt.Replace(m)
+	if len(clears) != 2 || clears[0].GetId() != "a" || clears[1].GetId() != "c" || !isClear(clears[0]) {
+		t.Errorf("Expected clears for a and c, got %v", clears)
+	}
+	if clears := mt.Replace(m); len(clears) != 0 {
+		t.Errorf("Same manifest again shouldn't clear anything: %v", clears)
+	}
+
+	// Retained alerts from before subscribing, some swept by a replace and
+	// some published after it
+	mt = NewManifestTracker()
+	retained := NewManifest(CreateUpdate("web1", true, NewAlert("b")))
+	retained.Published = 2000
+	if !mt.SeenRetained("web1", "a", 1000) || !mt.SeenRetained("web1", "b", 2000) || !mt.SeenRetained("web1", "after", 3000) {
+		t.Errorf("Retained alerts before the manifest should be passed on")
+	}
+	clears = mt.Baseline(retained)
+	if len(clears) != 1 || clears[0].GetId() != "a" {
+		t.Errorf("Expected a retained manifest to clear just the retained a, got %v", clears)
+	}
+	if mt.SeenRetained("web1", "c", 1000) || mt.SeenRetained("web1", "unknown", 0) {
+		t.Errorf("Retained alerts not in their source's manifest, from before it, should be cleared")
+	}
+	if !mt.SeenRetained("web1", "b", 0) || !mt.SeenRetained("web1", "later", 3000) || !mt.SeenRetained("web2", "c", 0) {
+		t.Errorf("Retained alerts in their source's manifest, or published after it, shouldn't be cleared")
+	}
+	mt.Seen("web1", "live")
+	if clears := mt.Replace(NewManifest(CreateUpdate("web1", true))); len(clears) != 4 {
+		t.Errorf("Expected after, b, later and live to be cleared by a replace, got %v", clears)
+	}
+	if _, err := ParseManifest([]byte(`{"ids": []}`)); err == nil {
+		t.Errorf("Expected an error for a manifest without a source")
+	}
+}
+
+func TestMQTTClientSettings(t *testing.T) {
+	mqc, _ := CreateMQTTClient("test", "tcp://127.0.0.1:1", "govealert")
+	if mqc.QoS != 1 || mqc.Retain || mqc.Persistent {
+		t.Errorf("Unexpected MQTT defaults: %+v", mqc)
+	}
+	up := CreateUpdate("test", false, NewAlert("a"))
+	mqc.QoS = 3
+	if err := mqc.Send(context.Background(), up); err == nil || !strings.Contains(err.Error(), "QoS") {
+		t.Errorf("Expected an error for QoS 3, got %v", err)
+	}
+	mqc.QoS, mqc.Persistent = 2, true
+	if err := mqc.Send(context.Background(), up); err == nil || !strings.Contains(err.Error(), "ClientID") {
+		t.Errorf("Expected an error for a persistent session without a ClientID, got %v", err)
+	}
+}
+
+func TestMQTTConnectFailure(t *testing.T) {
+	versions := []int{3}
+	if MQTT5Supported {
+		versions = append(versions, 5)
+	}
+	for _, version := range versions {
+		// Nothing listens on port 1
+		mqc, _ := CreateMQTTClient("test", "tcp://127.0.0.1:1", "govealert")
+		mqc.MQTTVersion = version
+		mqc.ConnectTimeout = 500 * time.Millisecond
+		start := time.Now()
+		err := mqc.Send(context.Background(), CreateUpdate("test", false, NewAlert("a")))
+		if err == nil {
+			t.Errorf("MQTT %d: expected an error with no broker", version)
+		}
+		if took := time.Since(start); took > mqc.ConnectTimeout+time.Second {
+			t.Errorf("MQTT %d: took %s to fail, with a timeout of %s", version, took, mqc.ConnectTimeout)
+		}
+		mqc.Close()
+	}
+}
+
+// A connection that's been lost, which records being disconnected.
+type lostConn struct {
+	disconnected bool
+}
+
+func (c *lostConn) publish(ctx context.Context, msg *mqttMessage) func(context.Context) error {
+	return func(context.Context) error { return errors.New("Not connected") }
+}
+func (c *lostConn) connected() bool { return false }
+func (c *lostConn) disconnect()     { c.disconnected = true }
+
+func TestMQTTLostConnection(t *testing.T) {
+	mqc, _ := CreateMQTTClient("test", "tcp://127.0.0.1:1", "govealert")
+	lost := &lostConn{}
+	mqc.conn = lost
+	// A bad QoS stops it getting as far as dialling
+	mqc.QoS = 3
+	if _, err := mqc.connect(context.Background()); err == nil {
+		t.Fatalf("Expected an error for QoS 3")
+	}
+	if !lost.disconnected || mqc.conn != nil {
+		t.Errorf("Expected the lost connection to be disconnected and dropped before redialling")
+	}
+}
+
+func TestMQTTProperties(t *testing.T) {
+	al := NewAlert("disk", WithImportance(ImportanceHigh))
+	up := CreateUpdate("web1", false, al)
+	props := alertProperties(up, al, 1500000000123)
+	if props["source"] != "web1" || props["importance"] != "75" || props["transmission_id"] == "" || props["published"] != "1500000000123" {
+		t.Errorf("Wrong user properties: %v", props)
+	}
+	if _, ok := alertProperties(up, NewAlert("plain"), 0)["importance"]; ok {
+		t.Errorf("Importance shouldn't be given when it's not set")
+	}
+	raw, _ := MarshalAlertJSON("web1", al)
+	if _, back, err := UnmarshalMQTTAlertAs(contentType(EncodingJSON), raw); err != nil || back.GetId() != "disk" {
+		t.Errorf("Failed to unmarshal by content type: %v %v", back, err)
+	}
+	if _, _, err := UnmarshalMQTTAlertAs(ContentTypeProtobuf, raw); err == nil {
+		t.Errorf("Expected JSON not to unmarshal as protobuf")
+	}
+	mqc, _ := CreateMQTTClient("web1", "tcp://127.0.0.1:1", "govealert")
+	mqc.MQTTVersion = 4
+	if err := mqc.Send(context.Background(), up); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Errorf("Expected an error for MQTT version 4, got %v", err)
+	}
+}
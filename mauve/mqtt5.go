@@ -0,0 +1,136 @@
+//go:build mqtt5
+// +build mqtt5
+
+package mauve
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// Whether govealert was built with MQTT 5 support (the mqtt5 build tag).
+const MQTT5Supported = true
+
+// How often, in seconds, to ping the broker to keep an MQTT 5 connection
+// open.
+const mqtt5KeepAlive = 30
+
+type mqtt5Conn struct {
+	client *paho.Client
+	mu     sync.Mutex
+	lost   bool
+}
+
+func (mqc *MQTTClient) dialMQTT5(ctx context.Context, clientID string) (mqttConn, error) {
+	netConn, err := DialBroker(ctx, mqc.Broker, mqc.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	c := &mqtt5Conn{}
+	c.client = paho.NewClient(paho.ClientConfig{
+		ClientID: clientID,
+		Conn:     netConn,
+		OnClientError: func(err error) {
+			c.connectionLost(mqc.Broker, err)
+		},
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			c.connectionLost(mqc.Broker, fmt.Errorf("disconnected by the broker, reason %d", d.ReasonCode))
+		},
+	})
+	cp := &paho.Connect{
+		ClientID:     clientID,
+		KeepAlive:    mqtt5KeepAlive,
+		CleanStart:   !mqc.Persistent,
+		Username:     mqc.Username,
+		UsernameFlag: mqc.Username != "",
+		Password:     []byte(mqc.Password),
+		PasswordFlag: mqc.Password != "",
+	}
+	if mqc.Persistent {
+		// Without this the broker drops the session as soon as we disconnect
+		never := uint32(0xFFFFFFFF)
+		cp.Properties = &paho.ConnectProperties{SessionExpiryInterval: &never}
+	}
+	ca, err := c.client.Connect(ctx, cp)
+	if err == nil && ca.ReasonCode >= 0x80 {
+		err = fmt.Errorf("refused by the broker, reason %d", ca.ReasonCode)
+	}
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *mqtt5Conn) connectionLost(broker string, reason error) {
+	log.Printf("Lost connection to MQTT broker %s: %s", broker, reason)
+	c.mu.Lock()
+	c.lost = true
+	c.mu.Unlock()
+}
+
+// Sorted, so the properties are always in the same order.
+func userProperties(props map[string]string) paho.UserProperties {
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ret := make(paho.UserProperties, len(keys))
+	for i, k := range keys {
+		ret[i] = paho.UserProperty{Key: k, Value: props[k]}
+	}
+	return ret
+}
+
+// Publishing with paho.golang blocks until the broker has the message, so
+// it's done in the background to wait for together with any others.
+func (c *mqtt5Conn) publish(ctx context.Context, msg *mqttMessage) func(context.Context) error {
+	p := &paho.Publish{
+		QoS:     msg.QoS,
+		Retain:  msg.Retain,
+		Topic:   msg.Topic,
+		Payload: msg.Payload,
+		Properties: &paho.PublishProperties{
+			ContentType: msg.ContentType,
+			User:        userProperties(msg.Properties),
+		},
+	}
+	if msg.Expiry > 0 {
+		// In whole seconds, rounding up so it's never zero
+		expiry := uint32((msg.Expiry + time.Second - 1) / time.Second)
+		p.Properties.MessageExpiry = &expiry
+	}
+	done := make(chan error, 1)
+	go func() {
+		pr, err := c.client.Publish(ctx, p)
+		if err == nil && pr != nil && pr.ReasonCode >= 0x80 {
+			err = fmt.Errorf("refused by the broker, reason %d", pr.ReasonCode)
+		}
+		done <- err
+	}()
+	return func(ctx context.Context) error {
+		select {
+		case err := <-done:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *mqtt5Conn) connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.lost
+}
+
+func (c *mqtt5Conn) disconnect() {
+	c.client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+}
@@ -0,0 +1,18 @@
+//go:build !mqtt5
+// +build !mqtt5
+
+package mauve
+
+import (
+	"context"
+	"errors"
+)
+
+// Whether govealert was built with MQTT 5 support (the mqtt5 build tag).
+const MQTT5Supported = false
+
+var errNoMQTT5 = errors.New("MQTT 5 isn't supported by this build, it needs the mqtt5 build tag")
+
+func (mqc *MQTTClient) dialMQTT5(ctx context.Context, clientID string) (mqttConn, error) {
+	return nil, errNoMQTT5
+}
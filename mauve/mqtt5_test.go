@@ -0,0 +1,75 @@
+//go:build mqtt5
+// +build mqtt5
+
+package mauve
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// Needs a real MQTT 5 broker, e.g. GOVEALERT_TEST_MQTT5_BROKER=tcp://localhost:1883
+func TestMQTT5(t *testing.T) {
+	broker := os.Getenv("GOVEALERT_TEST_MQTT5_BROKER")
+	if broker == "" {
+		t.Skip("GOVEALERT_TEST_MQTT5_BROKER isn't set")
+	}
+	base := "govealert-test/" + RandomID()
+	mqc, _ := CreateMQTTClient("web1", broker, base)
+	mqc.MQTTVersion, mqc.Retain, mqc.Encoding, mqc.RaiseExpiry = 5, true, EncodingJSON, time.Hour
+	defer mqc.Close()
+	al := NewAlert("disk", WithSubject("db1"), WithImportance(ImportanceHigh))
+	up := CreateUpdate("web1", false, al)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := mqc.Send(ctx, up); err != nil {
+		t.Fatalf("Failed to publish with MQTT 5: %s", err)
+	}
+
+	// The alert was retained, so subscribing afterwards should get it
+	conn, err := DialBroker(ctx, broker, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan *paho.Publish, 1)
+	client := paho.NewClient(paho.ClientConfig{
+		Conn:   conn,
+		Router: paho.NewSingleHandlerRouter(func(p *paho.Publish) { received <- p }),
+	})
+	if _, err := client.Connect(ctx, &paho.Connect{ClientID: "govealert-test-" + RandomID(), CleanStart: true, KeepAlive: 30}); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(&paho.Disconnect{})
+	scheme, _ := NewTopicScheme(base, DefaultTopicTemplate)
+	topic := scheme.Topic("web1", al)
+	if _, err := client.Subscribe(ctx, &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	var p *paho.Publish
+	select {
+	case p = <-received:
+	case <-ctx.Done():
+		t.Fatalf("Retained alert never arrived on %s", topic)
+	}
+	// Tidy up the retained alert
+	client.Publish(ctx, &paho.Publish{Topic: topic, Retain: true, QoS: 1})
+
+	props := p.Properties
+	if props == nil || props.ContentType != ContentTypeJSON {
+		t.Fatalf("Wrong content type: %+v", props)
+	}
+	if props.User.Get("source") != "web1" || props.User.Get("importance") != "75" || props.User.Get("transmission_id") == "" {
+		t.Errorf("Missing user properties: %v", props.User)
+	}
+	if props.MessageExpiry == nil || *props.MessageExpiry > 3600 {
+		t.Errorf("Raise doesn't have the right expiry: %v", props.MessageExpiry)
+	}
+	source, back, err := UnmarshalMQTTAlertAs(props.ContentType, p.Payload)
+	if err != nil || source != "web1" || back.GetId() != "disk" {
+		t.Errorf("Alert didn't come back: %s %v %v", source, back, err)
+	}
+}
@@ -1,69 +1,452 @@
 package mauve
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
-	
-	
-	"code.google.com/p/goprotobuf/proto"
-	 mqtt "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
 )
 
+var _ Sender = (*MQTTClient)(nil)
+
 type MQTTClient struct {
-	Broker string
+	Broker    string
 	BaseTopic string
-	Source string
-	
+	Source    string
+	// The layout of the topics alerts are published to, either a template
+	// or one of the TopicTemplates. Empty means DefaultTopicTemplate.
+	TopicTemplate string
+	// How alerts are encoded, EncodingProtobuf (the default if empty) or
+	// EncodingJSON.
+	Encoding string
+	// If set, updates which fail Validate are refused rather than sent with
+	// a warning.
+	Strict bool
+	// Used to connect to ssl:// and tls:// brokers, see NewTLSConfig. If
+	// nil, the system's CAs are trusted and no client certificate is sent.
+	TLSConfig *tls.Config
+	// Credentials for brokers which need them. For brokers which take a
+	// token (e.g. a JWT) instead, it goes in Password. See ReadMQTTPassword.
+	Username string
+	Password string
+	// Client IDs are this followed by a random string, so that each
+	// connection's is unique but broker ACLs can still match on the start
+	// of it, e.g. "govealert-host.example.com-".
+	ClientIDPrefix string
+	// If set, the client ID used instead of ClientIDPrefix and a random
+	// string. Needed for Persistent.
+	ClientID string
+	// Keep the session on the broker between connections (i.e. don't ask
+	// for a clean session), so messages in flight when the connection drops
+	// aren't lost.
+	Persistent bool
+	// The QoS to publish with: 0 (at most once), 1 (at least once, the
+	// default from CreateMQTTClient) or 2 (exactly once).
+	QoS byte
+	// Publish alerts retained, so each alert's topic holds its last state
+	// for anyone subscribing later.
+	Retain bool
+	// The version of MQTT to speak: 3 (the default if zero, really 3.1.1)
+	// or 5, which needs govealert built with the mqtt5 tag. MQTT 5 adds the
+	// source, importance and transmission id to each alert as user
+	// properties, and the encoding as the content type.
+	MQTTVersion int
+	// With MQTT 5, raises which haven't been delivered this long after
+	// being published are dropped by the broker. Zero means never.
+	RaiseExpiry time.Duration
+	// How long to wait for the broker to accept a connection, zero meaning
+	// DefaultMQTTConnectTimeout.
+	ConnectTimeout time.Duration
+
 	// non-exported fields
-	batchedAlerts []*Alert
+	batch    alertBatch
+	inflight sync.WaitGroup // Sends which Close waits for
+	mu       sync.Mutex     // guards everything below
+	conn     mqttConn
+	closed   bool
+}
+
+// A message to publish, along with the MQTT 5 properties (which are
+// dropped for MQTT 3).
+type mqttMessage struct {
+	Topic       string
+	QoS         byte
+	Retain      bool
+	Payload     []byte
+	ContentType string
+	Expiry      time.Duration
+	Properties  map[string]string
+}
+
+// A connection to the broker, in one version of MQTT or another.
+type mqttConn interface {
+	// Start publishing a message, returning a function to wait for it
+	// to finish.
+	publish(ctx context.Context, msg *mqttMessage) func(context.Context) error
+	connected() bool
+	disconnect()
+}
+
+type mqtt3Conn struct {
+	client *mqtt.Client
+}
+
+func (c *mqtt3Conn) publish(ctx context.Context, msg *mqttMessage) func(context.Context) error {
+	tok := c.client.Publish(msg.Topic, msg.QoS, msg.Retain, msg.Payload)
+	return func(ctx context.Context) error { return waitToken(ctx, tok) }
 }
 
-func CreateMQTTClient(source string, broker string, baseTopic string) (*MQTTClient,error) {
+func (c *mqtt3Conn) connected() bool { return c.client.IsConnected() }
+func (c *mqtt3Conn) disconnect()     { c.client.Disconnect(mqttQuiesce) }
+
+// How long MQTTClient waits to connect to a broker by default.
+const DefaultMQTTConnectTimeout = 30 * time.Second
+
+// How long, in milliseconds, Close gives the MQTT library to finish off
+// before disconnecting.
+const mqttQuiesce = 250
+
+// AlertError is one alert which couldn't be published to the broker.
+type AlertError struct {
+	Id    string
+	Topic string
+	Err   error
+}
+
+func (ae *AlertError) Error() string {
+	return fmt.Sprintf("%s: %s", ae.Topic, ae.Err)
+}
+
+// PublishError is returned by MQTTClient.Send when at least one of the
+// update's alerts didn't reach the broker. Published counts the ones that
+// did.
+type PublishError struct {
+	Failed    []*AlertError
+	Published int
+}
+
+func (pe *PublishError) Error() string {
+	msgs := make([]string, len(pe.Failed))
+	for i, ae := range pe.Failed {
+		msgs[i] = ae.Error()
+	}
+	return fmt.Sprintf("Failed to publish %d of %d alerts: %s", len(pe.Failed), len(pe.Failed)+pe.Published, strings.Join(msgs, "; "))
+}
+
+// Just the alerts from the update which failed. For a replace, the
+// manifest is only published once every alert has been, so they all need
+// to go again.
+func (pe *PublishError) failedAlerts(up *AlertUpdate) []*Alert {
+	if up.GetReplace() {
+		return up.Alert
+	}
+	failed := make(map[string]bool)
+	for _, ae := range pe.Failed {
+		failed[ae.Id] = true
+	}
+	var ret []*Alert
+	for _, al := range up.Alert {
+		if failed[al.GetId()] {
+			ret = append(ret, al)
+		}
+	}
+	return ret
+}
+
+func CreateMQTTClient(source string, broker string, baseTopic string) (*MQTTClient, error) {
 	mqc := &MQTTClient{
-		Broker: broker,
+		Broker:    broker,
 		BaseTopic: baseTopic,
-		Source: source,
+		Source:    source,
+		QoS:       1,
+	}
+	return mqc, nil
+}
+
+// The environment variable ReadMQTTPassword falls back to.
+const MQTTPasswordEnv = "GOVEALERT_MQTT_PASSWORD"
+
+// Read the password for an MQTT broker from a file, or if path is empty
+// from the GOVEALERT_MQTT_PASSWORD environment variable, so that it isn't
+// visible on the command line. Surrounding whitespace is trimmed, and an
+// empty password is returned if neither is set.
+func ReadMQTTPassword(path string) (string, error) {
+	if path == "" {
+		return strings.TrimSpace(os.Getenv(MQTTPasswordEnv)), nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read MQTT password: %s", err)
 	}
-	mqc.batchedAlerts = make([]*Alert, 0)
-	return mqc,nil
+	return strings.TrimSpace(string(raw)), nil
 }
 
+// Add an alert to be sent with the next SendBatchedAlerts or Flush, this is
+// safe to call from many goroutines at once.
 func (mqc *MQTTClient) AddBatchedAlert(alert *Alert) {
-	mqc.batchedAlerts = append(mqc.batchedAlerts,alert)
+	mqc.batch.add(alert)
 }
 
-func alertTopic(al *Alert, source string) string {
-    return fmt.Sprintf("%s/%s/%s", source, *al.Subject, *al.Id)
+func (mqc *MQTTClient) topicScheme() (*TopicScheme, error) {
+	template := mqc.TopicTemplate
+	if template == "" {
+		template = DefaultTopicTemplate
+	}
+	return NewTopicScheme(mqc.BaseTopic, template)
 }
 
 func (mqc *MQTTClient) SendBatchedAlerts(replace bool) error {
+	return mqc.sendBatch(context.Background(), replace)
+}
+
+func (mqc *MQTTClient) Flush(ctx context.Context) error {
+	return mqc.sendBatch(ctx, false)
+}
+
+// The batch is emptied as it's sent, and whichever alerts couldn't be
+// published are put back, apart from invalid ones refused in strict mode.
+func (mqc *MQTTClient) sendBatch(ctx context.Context, replace bool) error {
+	alerts := mqc.batch.take()
+	if len(alerts) == 0 && !replace {
+		// Nothing to do, whereas an empty replace clears everything
+		return nil
+	}
+	up := CreateUpdate(mqc.Source, replace, alerts...)
+	err := mqc.Send(ctx, up)
+	switch e := err.(type) {
+	case nil:
+	case *ValidationError:
+		mqc.batch.putBack(validAlerts(alerts))
+	case *PublishError:
+		mqc.batch.putBack(e.failedAlerts(up))
+	default:
+		mqc.batch.putBack(alerts)
+	}
+	return err
+}
+
+// Return the connection to the broker, connecting (or reconnecting, if the
+// last connection was lost) if need be. The connection is then kept open
+// for later sends until Close is called, which waits for mqc.inflight.Done
+// to be called for every connection returned.
+func (mqc *MQTTClient) connect(ctx context.Context) (mqttConn, error) {
+	mqc.mu.Lock()
+	defer mqc.mu.Unlock()
+	if mqc.closed {
+		return nil, ErrClosed
+	}
+	if mqc.conn != nil && mqc.conn.connected() {
+		mqc.inflight.Add(1)
+		return mqc.conn, nil
+	}
+	if mqc.conn != nil {
+		// The connection's been lost, so make sure the old client has given
+		// up before we make a new one with the same client ID
+		mqc.conn.disconnect()
+		mqc.conn = nil
+	}
+	if err := CheckTLSBroker(mqc.Broker, mqc.TLSConfig); err != nil {
+		return nil, err
+	}
+	if mqc.QoS > 2 {
+		return nil, fmt.Errorf("Bad MQTT QoS %d, should be 0, 1 or 2", mqc.QoS)
+	}
+	clientID := mqc.ClientID
+	if clientID == "" {
+		if mqc.Persistent {
+			return nil, fmt.Errorf("A persistent MQTT session needs a fixed ClientID")
+		}
+		clientID = mqc.ClientIDPrefix + RandomID()
+	}
+	timeout := mqc.ConnectTimeout
+	if timeout <= 0 {
+		timeout = DefaultMQTTConnectTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var conn mqttConn
 	var err error
-	mqttOpts := mqtt.NewClientOptions().AddBroker(mqc.Broker).SetClientID(RandomID()).SetCleanSession(true).SetConnectionLostHandler(func(client *mqtt.Client, reason error){
-		err = reason
+	switch mqc.MQTTVersion {
+	case 0, 3:
+		conn, err = mqc.dialMQTT3(ctx, clientID, timeout)
+	case 5:
+		conn, err = mqc.dialMQTT5(ctx, clientID)
+	default:
+		return nil, fmt.Errorf("Unknown MQTT version %d, should be 3 or 5", mqc.MQTTVersion)
+	}
+	if err != nil {
+		if err == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %s", timeout)
+		}
+		return nil, fmt.Errorf("Failed to connect to MQTT broker %s: %s", mqc.Broker, err)
+	}
+	log.Printf("Connected to Broker")
+	mqc.conn = conn
+	mqc.inflight.Add(1)
+	return conn, nil
+}
+
+func (mqc *MQTTClient) dialMQTT3(ctx context.Context, clientID string, timeout time.Duration) (mqttConn, error) {
+	mqttOpts := mqtt.NewClientOptions().AddBroker(mqc.Broker).SetClientID(clientID).SetCleanSession(!mqc.Persistent).SetConnectionLostHandler(func(client *mqtt.Client, reason error) {
+		log.Printf("Lost connection to MQTT broker %s: %s", mqc.Broker, reason)
 	})
+	// connect redials when the connection's lost, so the client mustn't
+	// reconnect by itself as well
+	mqttOpts.SetAutoReconnect(false)
+	if mqc.TLSConfig != nil {
+		mqttOpts.SetTLSConfig(mqc.TLSConfig)
+	}
+	if mqc.Username != "" {
+		mqttOpts.SetUsername(mqc.Username)
+	}
+	if mqc.Password != "" {
+		mqttOpts.SetPassword(mqc.Password)
+	}
+	mqttOpts.SetConnectTimeout(timeout)
 	client := mqtt.NewClient(mqttOpts)
-	if tok := client.Connect(); tok.Error() != nil {
+	if err := waitToken(ctx, client.Connect()); err != nil {
+		return nil, err
+	}
+	return &mqtt3Conn{client}, nil
+}
+
+// The MQTT 5 user properties of an alert.
+func alertProperties(up *AlertUpdate, al *Alert, published int64) map[string]string {
+	props := map[string]string{
+		"source":          up.GetSource(),
+		"transmission_id": strconv.FormatUint(up.GetTransmissionId(), 10),
+		"published":       strconv.FormatInt(published, 10),
+	}
+	if al.Importance != nil {
+		props["importance"] = strconv.FormatUint(uint64(al.GetImportance()), 10)
+	}
+	return props
+}
+
+// Publish each Alert in the update to the broker, using the update's
+// source in the topic, followed for a replace by the source's Manifest.
+// Waiting on the broker stops when ctx is done. If any alert wasn't
+// published the error is a *PublishError saying which.
+func (mqc *MQTTClient) Send(ctx context.Context, up *AlertUpdate) error {
+	if err := validateForSend(up, mqc.Strict); err != nil {
 		return err
-	} else {
-	    log.Printf("Connected to Broker")
-	}
-	if replace {
-		log.Printf("Not possible to use replace with MQTT")
-	}
-	// There's no real notion of Updates or Replace in MQTT
-	for _,al := range mqc.batchedAlerts {
-	    var pkt []byte
-	    var err error
-	    pkt, err = proto.Marshal(al)
-	    if err != nil {
-	        log.Fatalf("Marshalling fail: %v", err)
-	    }
-	    // send the packet
-	    log.Printf("Sending MQTT transport packet: %s", al)
-	    fullTopic := fmt.Sprintf("%s/%s", mqc.BaseTopic, alertTopic(al, mqc.Source))
-	    mqttTok := client.Publish(fullTopic, byte(1), false, pkt)
-	    mqttTok.Wait()
-	    log.Printf("Sent MQTT transport packet: %s", al)
 	}
-	return err
-}
\ No newline at end of file
+	scheme, err := mqc.topicScheme()
+	if err != nil {
+		return err
+	}
+	conn, err := mqc.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer mqc.inflight.Done()
+	published := publishedTime(time.Now())
+	// There's no real notion of Updates in MQTT, so each alert is published
+	// separately, and all are waited for together.
+	pe := &PublishError{}
+	waits := make([]func(context.Context) error, len(up.Alert))
+	topics := make([]string, len(up.Alert))
+	for i, al := range up.Alert {
+		topics[i] = scheme.Topic(up.GetSource(), al)
+		pkt, err := marshalMQTTAlert(mqc.Encoding, up.GetSource(), al, published)
+		if err != nil {
+			pe.Failed = append(pe.Failed, &AlertError{al.GetId(), topics[i], fmt.Errorf("Failed to marshal: %s", err)})
+			continue
+		}
+		msg := &mqttMessage{
+			Topic:       topics[i],
+			QoS:         mqc.QoS,
+			Retain:      mqc.Retain,
+			Payload:     pkt,
+			ContentType: contentType(mqc.Encoding),
+			Properties:  alertProperties(up, al, published),
+		}
+		if !isClear(al) {
+			msg.Expiry = mqc.RaiseExpiry
+		}
+		log.Printf("Sending MQTT transport packet: %s", al)
+		waits[i] = conn.publish(ctx, msg)
+	}
+	for i, wait := range waits {
+		if wait == nil {
+			continue
+		}
+		if err := wait(ctx); err != nil {
+			pe.Failed = append(pe.Failed, &AlertError{up.Alert[i].GetId(), topics[i], err})
+			continue
+		}
+		pe.Published++
+		log.Printf("Sent MQTT transport packet: %s", up.Alert[i])
+	}
+	// A replace is done with a manifest, once the alerts are all there
+	if up.GetReplace() && len(pe.Failed) == 0 {
+		topic := scheme.ManifestTopic(up.GetSource())
+		m := NewManifest(up)
+		m.Published = published
+		pkt, err := json.Marshal(m)
+		if err == nil {
+			err = conn.publish(ctx, &mqttMessage{
+				Topic:       topic,
+				QoS:         mqc.QoS,
+				Retain:      true,
+				Payload:     pkt,
+				ContentType: ContentTypeJSON,
+				Properties:  map[string]string{"source": up.GetSource()},
+			})(ctx)
+		}
+		if err != nil {
+			pe.Failed = append(pe.Failed, &AlertError{manifestLevel, topic, err})
+		}
+	}
+	if len(pe.Failed) > 0 {
+		return pe
+	}
+	return nil
+}
+
+// Wait for any sends in progress, then disconnect from the broker, if
+// connected, and stop the client being used again.
+func (mqc *MQTTClient) Close() error {
+	mqc.mu.Lock()
+	if mqc.closed {
+		mqc.mu.Unlock()
+		return nil
+	}
+	mqc.closed = true
+	mqc.mu.Unlock()
+
+	mqc.inflight.Wait()
+	mqc.mu.Lock()
+	defer mqc.mu.Unlock()
+	if mqc.conn != nil && mqc.conn.connected() {
+		mqc.conn.disconnect()
+		log.Printf("Disconnected from MQTT broker %s", mqc.Broker)
+	}
+	mqc.conn = nil
+	return nil
+}
+
+// Wait for an MQTT operation to complete, or for ctx to be done, whichever
+// happens first.
+func waitToken(ctx context.Context, tok mqtt.Token) error {
+	done := make(chan struct{})
+	go func() {
+		tok.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return tok.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,199 @@
+package mauve
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// How alerts are encoded when published over MQTT.
+const (
+	EncodingProtobuf = "protobuf"
+	EncodingJSON     = "json"
+)
+
+// The MQTT 5 content types of each encoding.
+const (
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeJSON     = "application/json"
+)
+
+func contentType(encoding string) string {
+	if encoding == EncodingJSON {
+		return ContentTypeJSON
+	}
+	return ContentTypeProtobuf
+}
+
+// Check an encoding name is one MQTTClient knows, empty meaning protobuf.
+func ParseEncoding(raw string) (string, error) {
+	switch raw {
+	case "", EncodingProtobuf:
+		return EncodingProtobuf, nil
+	case EncodingJSON:
+		return EncodingJSON, nil
+	}
+	return "", fmt.Errorf("Unknown MQTT encoding %q, should be protobuf or json", raw)
+}
+
+// JSONAlert is the JSON form of an alert published over MQTT, as described
+// in README-MQTT.md. The field names match those of Alert, so anything
+// which unmarshalled an Alert directly from JSON still works. Each time is
+// given both as a UNIX time, where zero has the same meaning as in Alert,
+// and (unless it's zero) in RFC 3339 form. When decoding, the UNIX time
+// wins if both are given.
+type JSONAlert struct {
+	Id                   string `json:"id"`
+	Source               string `json:"source,omitempty"`
+	Subject              string `json:"subject,omitempty"`
+	Summary              string `json:"summary,omitempty"`
+	Detail               string `json:"detail,omitempty"`
+	Importance           uint32 `json:"importance,omitempty"`
+	RaiseTime            uint64 `json:"raise_time"`
+	RaiseTimeRFC3339     string `json:"raise_time_rfc3339,omitempty"`
+	ClearTime            uint64 `json:"clear_time"`
+	ClearTimeRFC3339     string `json:"clear_time_rfc3339,omitempty"`
+	SuppressUntil        uint64 `json:"suppress_until"`
+	SuppressUntilRFC3339 string `json:"suppress_until_rfc3339,omitempty"`
+	// When it was published, in milliseconds since the UNIX epoch, so that
+	// receivers can tell if it came after a replace (see Manifest)
+	Published int64 `json:"published,omitempty"`
+}
+
+// A time as Published gives it.
+func publishedTime(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// The Published time of a JSON alert, or zero if it's not JSON or doesn't
+// say.
+func JSONPublished(payload []byte) int64 {
+	var ja JSONAlert
+	if len(payload) == 0 || payload[0] != '{' || json.Unmarshal(payload, &ja) != nil {
+		return 0
+	}
+	return ja.Published
+}
+
+func rfc3339Time(t uint64) string {
+	if t == 0 {
+		return ""
+	}
+	return time.Unix(int64(t), 0).UTC().Format(time.RFC3339)
+}
+
+func parseJSONTime(epoch uint64, rfc string) (*uint64, error) {
+	if epoch == 0 && rfc != "" {
+		t, err := time.Parse(time.RFC3339, rfc)
+		if err != nil {
+			return nil, err
+		}
+		if t.Unix() > 0 {
+			epoch = uint64(t.Unix())
+		}
+	}
+	return &epoch, nil
+}
+
+// Encode an alert from source as JSON.
+func MarshalAlertJSON(source string, al *Alert) ([]byte, error) {
+	return json.Marshal(newJSONAlert(source, al))
+}
+
+func newJSONAlert(source string, al *Alert) *JSONAlert {
+	return &JSONAlert{
+		Id:                   al.GetId(),
+		Source:               source,
+		Subject:              al.GetSubject(),
+		Summary:              al.GetSummary(),
+		Detail:               al.GetDetail(),
+		Importance:           al.GetImportance(),
+		RaiseTime:            al.GetRaiseTime(),
+		RaiseTimeRFC3339:     rfc3339Time(al.GetRaiseTime()),
+		ClearTime:            al.GetClearTime(),
+		ClearTimeRFC3339:     rfc3339Time(al.GetClearTime()),
+		SuppressUntil:        al.GetSuppressUntil(),
+		SuppressUntilRFC3339: rfc3339Time(al.GetSuppressUntil()),
+	}
+}
+
+// Decode an alert encoded by MarshalAlertJSON, returning its source too
+// (which is empty if it wasn't given).
+func UnmarshalAlertJSON(payload []byte) (string, *Alert, error) {
+	var ja JSONAlert
+	if err := json.Unmarshal(payload, &ja); err != nil {
+		return "", nil, err
+	}
+	if ja.Id == "" {
+		return "", nil, ErrMissingId
+	}
+	al := &Alert{Id: proto.String(ja.Id)}
+	if ja.Subject != "" {
+		al.Subject = proto.String(ja.Subject)
+	}
+	if ja.Summary != "" {
+		al.Summary = proto.String(ja.Summary)
+	}
+	if ja.Detail != "" {
+		al.Detail = proto.String(ja.Detail)
+	}
+	if ja.Importance != 0 {
+		al.Importance = proto.Uint32(ja.Importance)
+	}
+	var err error
+	if al.RaiseTime, err = parseJSONTime(ja.RaiseTime, ja.RaiseTimeRFC3339); err != nil {
+		return "", nil, fmt.Errorf("Bad raise time: %s", err)
+	}
+	if al.ClearTime, err = parseJSONTime(ja.ClearTime, ja.ClearTimeRFC3339); err != nil {
+		return "", nil, fmt.Errorf("Bad clear time: %s", err)
+	}
+	if al.SuppressUntil, err = parseJSONTime(ja.SuppressUntil, ja.SuppressUntilRFC3339); err != nil {
+		return "", nil, fmt.Errorf("Bad suppress until time: %s", err)
+	}
+	return ja.Source, al, nil
+}
+
+// Encode an alert from source for publishing over MQTT.
+func marshalMQTTAlert(encoding, source string, al *Alert, published int64) ([]byte, error) {
+	switch encoding {
+	case "", EncodingProtobuf:
+		return proto.Marshal(al)
+	case EncodingJSON:
+		ja := newJSONAlert(source, al)
+		ja.Published = published
+		return json.Marshal(ja)
+	}
+	return nil, fmt.Errorf("Unknown MQTT encoding %q", encoding)
+}
+
+// Decode an alert published over MQTT, as either JSON (if it starts with a
+// "{", which a protobuf Alert can't) or protobuf. The source is only
+// returned for JSON, as it's not part of a protobuf Alert.
+func UnmarshalMQTTAlert(payload []byte) (string, *Alert, error) {
+	if len(payload) > 0 && payload[0] == '{' {
+		return UnmarshalAlertJSON(payload)
+	}
+	al := new(Alert)
+	if err := proto.Unmarshal(payload, al); err != nil {
+		return "", nil, err
+	}
+	return "", al, nil
+}
+
+// Decode an alert published over MQTT with the given content type (from
+// MQTT 5), falling back to UnmarshalMQTTAlert if it's not one of ours.
+func UnmarshalMQTTAlertAs(contentType string, payload []byte) (string, *Alert, error) {
+	switch contentType {
+	case ContentTypeJSON:
+		return UnmarshalAlertJSON(payload)
+	case ContentTypeProtobuf:
+		al := new(Alert)
+		if err := proto.Unmarshal(payload, al); err != nil {
+			return "", nil, err
+		}
+		return "", al, nil
+	}
+	return UnmarshalMQTTAlert(payload)
+}
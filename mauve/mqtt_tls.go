@@ -0,0 +1,113 @@
+package mauve
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"time"
+)
+
+// Build the TLS configuration for connecting to an ssl:// or tls:// MQTT
+// broker. caFile is a PEM bundle of the CAs to trust instead of the
+// system's, and certFile and keyFile a PEM client certificate and key to
+// present to the broker; each can be left empty. serverName overrides the
+// name the broker's certificate is checked against, for when it's not the
+// one in the broker URL.
+func NewTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	conf := &tls.Config{ServerName: serverName}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CA bundle: %s", err)
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA bundle %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("A client certificate needs both a certificate and a key")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate: %s", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// Whether the broker URL is one the MQTT library connects to with TLS.
+func isTLSBroker(broker string) bool {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "ssl", "tls", "tcps", "wss":
+		return true
+	}
+	return false
+}
+
+// Check a TLS configuration will actually be used for the broker, rather
+// than the alerts quietly going in cleartext.
+func CheckTLSBroker(broker string, conf *tls.Config) error {
+	if conf != nil && !isTLSBroker(broker) {
+		return fmt.Errorf("TLS is configured but MQTT broker %s isn't an ssl:// or tls:// URL", broker)
+	}
+	return nil
+}
+
+// Open a network connection to an MQTT broker URL, with TLS for ssl://,
+// tls:// and tcps:// brokers, for MQTT libraries which are handed a
+// connection rather than a URL. Websockets aren't supported.
+func DialBroker(ctx context.Context, broker string, conf *tls.Config) (net.Conn, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, err
+	}
+	var secure bool
+	switch u.Scheme {
+	case "tcp":
+	case "ssl", "tls", "tcps":
+		secure = true
+	default:
+		return nil, fmt.Errorf("Can't connect to %s:// brokers", u.Scheme)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		port := "1883"
+		if secure {
+			port = "8883"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil || !secure {
+		return conn, err
+	}
+	if conf == nil {
+		conf = &tls.Config{}
+	}
+	if conf.ServerName == "" {
+		conf = conf.Clone()
+		conf.ServerName = u.Hostname()
+	}
+	tlsConn := tls.Client(conn, conf)
+	if deadline, ok := ctx.Deadline(); ok {
+		tlsConn.SetDeadline(deadline)
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
@@ -1,70 +1,357 @@
 package mauve
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"sync"
-	"log"
+	"math/rand"
 	"net"
-	
+	"strings"
+	"sync"
+	"time"
+
 	"code.google.com/p/goprotobuf/proto"
 )
+
+var _ Sender = (*ProtobufClient)(nil)
+
 type ProtobufClient struct {
-	Hosts []*MauveAlertService
+	Hosts  []*MauveAlertService
 	Source string
-	
+	// If set, every AlertUpdate is signed with this shared secret before
+	// being sent (see SignUpdate).
+	Secret []byte
+	// If set, updates which fail Validate are refused rather than sent with
+	// a warning.
+	Strict bool
+	// UDP gives no acknowledgement, so each update can be sent Repeat times
+	// (to every host), roughly RepeatInterval apart. The copies all have the
+	// same TransmissionId, so Mauve discards the extras.
+	Repeat         int
+	RepeatInterval time.Duration
+	// How many times to retry a failed write to a host before giving up on it.
+	Retries int
+	// With SRVWeighted, Hosts are tried one at a time, in order, until one
+	// can be sent to (see sendFailover). Otherwise every host is sent to at
+	// once.
+	Policy SRVPolicy
+	// If set, CreateProtobufClient looks up Hosts through this cache.
+	Cache *ServiceCache
+	// Used to look up Hosts and their addresses, the system's resolver if nil.
+	Resolver Resolver
+
 	// Some internal fields
-	batchedAlerts []*Alert
+	batch  alertBatch
+	mu     sync.Mutex
+	closed bool
+}
+
+// ErrNoHosts is returned when sending with a ProtobufClient that has no
+// Mauve hosts, rather than it being taken as delivered to all of them.
+var ErrNoHosts = errors.New("mauve: no Mauve hosts to send to")
+
+// The stage of sending an AlertUpdate to a single Mauve host at which
+// something went wrong.
+type SendStage string
+
+const (
+	StageResolve SendStage = "resolve"
+	StageDial    SendStage = "dial"
+	StageMarshal SendStage = "marshal"
+	StageWrite   SendStage = "write"
+)
+
+// HostError is the failure to deliver an AlertUpdate to one Mauve host.
+type HostError struct {
+	Host  *MauveAlertService
+	Stage SendStage
+	Err   error
+}
+
+func (he *HostError) Error() string {
+	return fmt.Sprintf("%s: %s failed: %s", he.Host, he.Stage, he.Err)
+}
+
+// SendError is returned by SendBatchedAlerts when at least one host didn't
+// get the AlertUpdate. Delivered counts the hosts which did, so callers can
+// decide for themselves whether a partial delivery is good enough.
+type SendError struct {
+	Failed    []*HostError
+	Delivered int
+}
+
+func (se *SendError) Error() string {
+	msgs := make([]string, len(se.Failed))
+	for i, he := range se.Failed {
+		msgs[i] = he.Error()
+	}
+	return fmt.Sprintf("Failed to send to %d of %d Mauve hosts: %s", len(se.Failed), len(se.Failed)+se.Delivered, strings.Join(msgs, "; "))
+}
+
+// A ProtobufOption sets one of the optional ProtobufClient fields when
+// passed to CreateProtobufClient.
+type ProtobufOption func(*ProtobufClient)
+
+// Send each update n times, roughly interval apart (see ProtobufClient.Repeat).
+func WithRepeat(n int, interval time.Duration) ProtobufOption {
+	return func(pbc *ProtobufClient) {
+		pbc.Repeat = n
+		pbc.RepeatInterval = interval
+	}
+}
+
+// Retry failed writes to each host n times.
+func WithRetries(n int) ProtobufOption {
+	return func(pbc *ProtobufClient) { pbc.Retries = n }
+}
+
+// Choose which of a domain's Mauve servers to send to (see SRVPolicy).
+func WithSRVPolicy(policy SRVPolicy) ProtobufOption {
+	return func(pbc *ProtobufClient) { pbc.Policy = policy }
+}
+
+// Look up Mauve servers through the cache, rather than on every run.
+func WithServiceCache(cache *ServiceCache) ProtobufOption {
+	return func(pbc *ProtobufClient) { pbc.Cache = cache }
+}
+
+// Look up Mauve servers with something other than the system's resolver,
+// such as a *net.Resolver using a particular DNS server, or a StaticResolver.
+func WithResolver(r Resolver) ProtobufOption {
+	return func(pbc *ProtobufClient) { pbc.Resolver = r }
 }
 
-func CreateProtobufClient(source string, domain string) (*ProtobufClient,error) {
+func (pbc *ProtobufClient) resolver() Resolver {
+	if pbc.Resolver != nil {
+		return pbc.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// Make a client which sends to the Mauve servers in the SRV records of
+// domain, or if domain is a host:port, to just that server.
+func CreateProtobufClient(source string, domain string, opts ...ProtobufOption) (*ProtobufClient, error) {
 	pbc := &ProtobufClient{}
 	pbc.Source = source
-	pbc.batchedAlerts = make([]*Alert,0)
-	ph,err := LookupMauvesForDomain(domain)
+	for _, opt := range opts {
+		opt(pbc)
+	}
+	lookup := func(domain string, policy SRVPolicy) ([]*MauveAlertService, error) {
+		if pbc.Cache != nil {
+			return pbc.Cache.LookupMauvesWith(pbc.resolver(), domain, policy)
+		}
+		return LookupMauvesWith(pbc.resolver(), domain, policy)
+	}
+	ph, err := resolveMauves(domain, pbc.Policy, lookup)
 	if err != nil {
-		return nil,fmt.Errorf("Failed to lookup Mauve for %s: %s", domain, err)
+		return nil, fmt.Errorf("Failed to lookup Mauve for %s: %s", domain, err)
 	}
 	pbc.Hosts = ph
-	return pbc,nil
+	return pbc, nil
 }
 
+// Add an alert to be sent with the next SendBatchedAlerts or Flush, this is
+// safe to call from many goroutines at once.
 func (pbc *ProtobufClient) AddBatchedAlert(alert *Alert) {
-	pbc.batchedAlerts = append(pbc.batchedAlerts,alert)
+	pbc.batch.add(alert)
 }
 
+// Send the batched alerts to every Mauve host in parallel. If any host
+// couldn't be sent to, the returned error is a *SendError.
 func (pbc *ProtobufClient) SendBatchedAlerts(replace bool) error {
+	return pbc.sendBatch(context.Background(), replace)
+}
+
+func (pbc *ProtobufClient) Flush(ctx context.Context) error {
+	return pbc.sendBatch(ctx, false)
+}
+
+// The batch is emptied as it's sent, and only put back if none of the
+// hosts got it, otherwise a permanently broken host would mean resending
+// everything forever. Likewise invalid alerts refused in strict mode are
+// dropped rather than put back.
+func (pbc *ProtobufClient) sendBatch(ctx context.Context, replace bool) error {
+	alerts := pbc.batch.take()
+	if len(alerts) == 0 && !replace {
+		// Nothing to do, whereas an empty replace clears everything
+		return nil
+	}
+	err := pbc.Send(ctx, CreateUpdate(pbc.Source, replace, alerts...))
+	switch e := err.(type) {
+	case nil:
+	case *ValidationError:
+		pbc.batch.putBack(validAlerts(alerts))
+	case *SendError:
+		if e.Delivered == 0 {
+			pbc.batch.putBack(alerts)
+		}
+	default:
+		pbc.batch.putBack(alerts)
+	}
+	return err
+}
+
+// Send an AlertUpdate to every Mauve host in parallel, giving up on any
+// host which hasn't been written to by the time ctx is done.
+func (pbc *ProtobufClient) Send(ctx context.Context, up *AlertUpdate) error {
+	pbc.mu.Lock()
+	closed := pbc.closed
+	pbc.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	if err := validateForSend(up, pbc.Strict); err != nil {
+		return err
+	}
+	if len(pbc.Hosts) == 0 {
+		return ErrNoHosts
+	}
+	if pbc.Secret != nil {
+		if err := SignUpdate(up, pbc.Secret); err != nil {
+			return err
+		}
+	}
+	mu, err := proto.Marshal(up)
+	if err != nil {
+		// Nothing can be sent if this fails, so every host has failed
+		se := &SendError{}
+		for _, srv := range pbc.Hosts {
+			se.Failed = append(se.Failed, &HostError{srv, StageMarshal, err})
+		}
+		return se
+	}
+	if pbc.Policy == SRVWeighted {
+		return pbc.sendFailover(ctx, mu)
+	}
+	results := make([]*HostError, len(pbc.Hosts))
 	wg := &sync.WaitGroup{}
-	up := CreateUpdate(pbc.Source, replace, pbc.batchedAlerts...)
 	wg.Add(len(pbc.Hosts))
-	for _,srv := range pbc.Hosts {
-		go func() {
+	for i, srv := range pbc.Hosts {
+		go func(i int, srv *MauveAlertService) {
 			defer wg.Done()
-			// This connects to Mauve over UDP and then waits on it's channel,
-			// any Alert that gets written to the channel will get wrapped in
-			// an AlertUpdate and then sent to the Mauve server
-			mauveIP,err := net.ResolveIPAddr("ip",srv.Host)
-			addr := &net.UDPAddr{mauveIP.IP,int(srv.Port),mauveIP.Zone}
-			if err != nil {
-				log.Fatalf("Cannot resolve mauvealert server: %s", addr)
-			}
-			conn, err := net.DialUDP("udp", nil, addr)
-			if err != nil {
-				log.Fatalf("Failed to connect to mauve: %s", addr)
+			results[i] = pbc.sendPacket(ctx, srv, mu)
+		}(i, srv)
+	}
+	wg.Wait()
+	se := &SendError{}
+	for _, he := range results {
+		if he != nil {
+			se.Failed = append(se.Failed, he)
+		} else {
+			se.Delivered++
+		}
+	}
+	if len(se.Failed) > 0 {
+		return se
+	}
+	return nil
+}
+
+// Send to each host in turn until one of them works, so it's only an
+// error if none of them could be sent to. "Works" only means the packet
+// was written: a host is skipped if it can't be looked up or dialled, or
+// the write fails, but over UDP there's no telling whether it arrived, so
+// a host which is down but still resolves won't be failed over from.
+func (pbc *ProtobufClient) sendFailover(ctx context.Context, pkt []byte) error {
+	se := &SendError{}
+	for _, srv := range pbc.Hosts {
+		he := pbc.sendPacket(ctx, srv, pkt)
+		if he == nil {
+			return nil
+		}
+		se.Failed = append(se.Failed, he)
+	}
+	return se
+}
+
+// There's nothing held open between sends, so this just stops the client
+// being used again.
+func (pbc *ProtobufClient) Close() error {
+	pbc.mu.Lock()
+	pbc.closed = true
+	pbc.mu.Unlock()
+	return nil
+}
+
+// Write a single marshalled AlertUpdate to a Mauve host over UDP, as many
+// times as the client's Repeat and Retries say to. It's only a failure if
+// none of the copies could be written.
+func (pbc *ProtobufClient) sendPacket(ctx context.Context, srv *MauveAlertService, pkt []byte) *HostError {
+	addr := &net.UDPAddr{IP: srv.IP, Port: int(srv.Port)}
+	if addr.IP == nil {
+		ips, err := pbc.resolver().LookupIPAddr(ctx, srv.Host)
+		if err != nil {
+			return &HostError{srv, StageResolve, err}
+		}
+		if len(ips) == 0 {
+			return &HostError{srv, StageResolve, fmt.Errorf("no addresses for %s", srv.Host)}
+		}
+		addr.IP, addr.Zone = ips[0].IP, ips[0].Zone
+	}
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "udp", addr.String())
+	if err != nil {
+		return &HostError{srv, StageDial, err}
+	}
+	defer conn.Close() // Just make sure that the connection gets flushed
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+	}
+	copies := pbc.Repeat
+	if copies < 1 {
+		copies = 1
+	}
+	var lastErr *HostError
+	written := false
+	for n := 0; n < copies; n++ {
+		if n > 0 {
+			if err := sleepContext(ctx, jitter(pbc.RepeatInterval)); err != nil {
+				break
 			}
-			defer conn.Close() // Just make sure that the connection gets flushed
-			//log.Printf("dialing...")
-			mu, err := proto.Marshal(up)
-			if err != nil {
-				log.Fatalf("Failed to marshal an alertUpdate: %s", err)
+		}
+		for attempt := 0; attempt <= pbc.Retries; attempt++ {
+			if attempt > 0 {
+				if err := sleepContext(ctx, jitter(retryInterval)); err != nil {
+					break
+				}
 			}
-			//log.Printf("Sent: %s", up.String())
-			if bytes, err := conn.Write(mu); err != nil {
-				log.Fatalf("Failed to send %d bytes of message: %s", bytes, err)
-			} else {
-				// log.Printf("Sent %d bytes to %s:%d", bytes, srv.Host, srv.Port)
+			if _, err := conn.Write(pkt); err != nil {
+				lastErr = &HostError{srv, StageWrite, err}
+				continue
 			}
-		}()
+			written = true
+			break
+		}
+	}
+	if !written {
+		if lastErr == nil {
+			lastErr = &HostError{srv, StageWrite, ctx.Err()}
+		}
+		return lastErr
 	}
-	wg.Wait()
 	return nil
 }
+
+// How long to wait before retrying a failed write.
+const retryInterval = 100 * time.Millisecond
+
+// Somewhere between half and one and a half times d, so that copies sent by
+// lots of hosts at once don't all arrive together.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+// Sleep for d, unless ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,82 @@
+package mauve
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+var (
+	ErrNoSignature  = errors.New("mauve: AlertUpdate is not signed")
+	ErrBadSignature = errors.New("mauve: AlertUpdate signature does not match")
+)
+
+// Work out the signature for an update, which is the HMAC-SHA256 (keyed
+// with the shared secret) of the update marshalled without any signature.
+func updateSignature(up *AlertUpdate, secret []byte) ([]byte, error) {
+	unsigned := *up
+	unsigned.Signature = nil
+	pkt, err := proto.Marshal(&unsigned)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(pkt)
+	return mac.Sum(nil), nil
+}
+
+// Set the Signature of an update using the shared secret. This needs to be
+// the last thing done to the update before it's marshalled, as changing
+// any other field will invalidate the signature.
+func SignUpdate(up *AlertUpdate, secret []byte) error {
+	sig, err := updateSignature(up, secret)
+	if err != nil {
+		return fmt.Errorf("Failed to sign AlertUpdate: %s", err)
+	}
+	up.Signature = sig
+	return nil
+}
+
+// Check that an update received from the network was signed with the shared
+// secret, returning ErrNoSignature or ErrBadSignature if it wasn't.
+func VerifyUpdate(up *AlertUpdate, secret []byte) error {
+	if len(up.Signature) == 0 {
+		return ErrNoSignature
+	}
+	sig, err := updateSignature(up, secret)
+	if err != nil {
+		return fmt.Errorf("Failed to verify AlertUpdate: %s", err)
+	}
+	if !hmac.Equal(sig, up.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// The same as CreateUpdate, but the update is signed with the shared secret.
+func CreateSignedUpdate(secret []byte, source string, replace bool, alerts ...*Alert) (*AlertUpdate, error) {
+	up := CreateUpdate(source, replace, alerts...)
+	if err := SignUpdate(up, secret); err != nil {
+		return nil, err
+	}
+	return up, nil
+}
+
+// Read a shared secret from a file, ignoring any whitespace (such as a
+// trailing newline) around it.
+func ReadSecretFile(path string) ([]byte, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret := bytes.TrimSpace(raw)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("Secret file %s is empty", path)
+	}
+	return secret, nil
+}
@@ -0,0 +1,197 @@
+package mauve
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// A Spool is a directory of AlertUpdates which couldn't be delivered, to be
+// sent again once the Mauve server or MQTT broker is reachable.
+type Spool struct {
+	Dir string
+	// Updates older than this have any raises dropped when they're resent,
+	// as they're likely to be out of date. Clears, and updates which
+	// replace, are always resent. Zero means nothing expires.
+	MaxAge time.Duration
+}
+
+// SpooledError is returned by SendOrSpool when an update couldn't be sent
+// but has been safely spooled.
+type SpooledError struct {
+	Err  error
+	Path string
+}
+
+func (se *SpooledError) Error() string {
+	return fmt.Sprintf("Spooled to %s for sending later: %s", se.Path, se.Err)
+}
+
+const spoolSuffix = ".pb"
+
+// Open (creating if need be) the spool in dir.
+func OpenSpool(dir string, maxAge time.Duration) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Failed to create spool: %s", err)
+	}
+	return &Spool{Dir: dir, MaxAge: maxAge}, nil
+}
+
+// Write an update to the spool. It's written to a temporary file first and
+// then renamed, so a half-written update will never be sent.
+func (sp *Spool) Put(up *AlertUpdate) (string, error) {
+	pkt, err := proto.Marshal(up)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(sp.Dir, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(pkt); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	// Named so that sorting them sends them in the order they were spooled
+	name := filepath.Join(sp.Dir, fmt.Sprintf("%020d-%016x%s", time.Now().UnixNano(), up.GetTransmissionId(), spoolSuffix))
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return name, nil
+}
+
+// The paths of every spooled update, oldest first.
+func (sp *Spool) Entries() ([]string, error) {
+	files, err := ioutil.ReadDir(sp.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, fi := range files {
+		if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), spoolSuffix) && !strings.HasPrefix(fi.Name(), ".") {
+			paths = append(paths, filepath.Join(sp.Dir, fi.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Send an update, and if it couldn't be delivered anywhere spool it and
+// return a *SpooledError. Invalid updates aren't spooled, as they'll never
+// be sent, and neither are ones that got to at least one Mauve host. Of
+// those only partly published to an MQTT broker, just the failed alerts are
+// spooled.
+func (sp *Spool) SendOrSpool(ctx context.Context, sender Sender, up *AlertUpdate) error {
+	err := sender.Send(ctx, up)
+	if err == nil {
+		return nil
+	}
+	switch e := err.(type) {
+	case *ValidationError:
+		return err
+	case *SendError:
+		if e.Delivered > 0 {
+			return err
+		}
+	case *PublishError:
+		// Only the alerts which didn't reach the broker need to go again
+		if e.Published > 0 {
+			up = CreateUpdate(up.GetSource(), up.GetReplace(), e.failedAlerts(up)...)
+		}
+	}
+	path, serr := sp.Put(up)
+	if serr != nil {
+		return fmt.Errorf("%s, and failed to spool it: %s", err, serr)
+	}
+	return &SpooledError{Err: err, Path: path}
+}
+
+// Whether an alert is a clear, rather than a raise (or a clear followed by
+// a later raise, as with heartbeats).
+func isClear(al *Alert) bool {
+	return al.GetClearTime() != 0 && al.GetClearTime() >= al.GetRaiseTime()
+}
+
+// Drop the raises from an update if it's too old to be worth sending, or
+// return nil if nothing in it is worth sending.
+func (sp *Spool) expire(up *AlertUpdate, now time.Time) *AlertUpdate {
+	sent := time.Unix(int64(up.GetTransmissionTime()), 0)
+	if sp.MaxAge == 0 || up.GetReplace() || now.Sub(sent) <= sp.MaxAge {
+		return up
+	}
+	var kept []*Alert
+	for _, al := range up.Alert {
+		if isClear(al) {
+			kept = append(kept, al)
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	up.Alert = kept
+	return up
+}
+
+// Send everything in the spool, oldest first, removing each update once
+// it's been delivered. This stops at the first update which can't be sent
+// (so they're never sent out of order) and returns how many were sent.
+func (sp *Spool) Flush(ctx context.Context, sender Sender) (int, error) {
+	paths, err := sp.Entries()
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, path := range paths {
+		pkt, err := ioutil.ReadFile(path)
+		if err != nil {
+			return sent, err
+		}
+		up := new(AlertUpdate)
+		if err := proto.Unmarshal(pkt, up); err != nil {
+			log.Printf("Removing unreadable spooled update %s: %s", path, err)
+			os.Remove(path)
+			continue
+		}
+		if up = sp.expire(up, time.Now()); up != nil {
+			// Sent as a new transmission, so it's not mistaken for a duplicate
+			resend := CreateUpdate(up.GetSource(), up.GetReplace(), up.Alert...)
+			err := sender.Send(ctx, resend)
+			switch e := err.(type) {
+			case nil:
+				sent++
+			case *ValidationError:
+				log.Printf("Removing spooled update %s which will never be sent: %s", path, err)
+			case *SendError:
+				if e.Delivered == 0 {
+					return sent, fmt.Errorf("Failed to send spooled update %s: %s", path, err)
+				}
+				sent++
+			default:
+				return sent, fmt.Errorf("Failed to send spooled update %s: %s", path, err)
+			}
+		}
+		if err := os.Remove(path); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
@@ -0,0 +1,175 @@
+package mauve
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The port Mauve servers listen on when no other is given.
+const DefaultMauvePort = 32741
+
+// A StaticResolver answers lookups from a file rather than DNS, for testing
+// offline or where the Mauve servers the public DNS gives are the wrong ones.
+// The file has a line for each Mauve server in a domain:
+//
+//	# domain        target[:port]         [priority [weight]]
+//	example.com     mauve1.example.com     10 50
+//	example.com     mauve2.example.com:999 20
+//
+// and can give addresses in the style of /etc/hosts:
+//
+//	192.0.2.1       mauve1.example.com
+//
+// Anything not in the file goes to the Fallback resolver, or fails if
+// that's nil.
+type StaticResolver struct {
+	Fallback Resolver
+	services map[string][]*net.SRV
+	addrs    map[string][]net.IPAddr
+}
+
+var _ Resolver = (*StaticResolver)(nil)
+
+// Read a StaticResolver's file.
+func LoadStaticResolver(path string) (*StaticResolver, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sr, err := ParseStaticResolver(f)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %s", path, err)
+	}
+	return sr, nil
+}
+
+// Parse lines in the format described for StaticResolver.
+func ParseStaticResolver(r io.Reader) (*StaticResolver, error) {
+	sr := &StaticResolver{
+		services: make(map[string][]*net.SRV),
+		addrs:    make(map[string][]net.IPAddr),
+	}
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected at least two fields", lineno)
+		}
+		if ip := net.ParseIP(fields[0]); ip != nil {
+			for _, name := range fields[1:] {
+				name = canonicalName(name)
+				sr.addrs[name] = append(sr.addrs[name], net.IPAddr{IP: ip})
+			}
+			continue
+		}
+		srv, err := parseStaticService(fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineno, err)
+		}
+		domain := canonicalName(fields[0])
+		sr.services[domain] = append(sr.services[domain], srv)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
+
+func parseStaticService(fields []string) (*net.SRV, error) {
+	if len(fields) > 3 {
+		return nil, fmt.Errorf("too many fields")
+	}
+	srv := &net.SRV{Target: fields[0], Port: DefaultMauvePort}
+	if _, _, err := net.SplitHostPort(fields[0]); err == nil {
+		mas, err := ParseMauveService(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		srv.Target, srv.Port = mas.Host, mas.Port
+	}
+	srv.Target = canonicalName(srv.Target) + "."
+	for i, dst := range []*uint16{&srv.Priority, &srv.Weight} {
+		if len(fields) <= i+1 {
+			break
+		}
+		n, err := strconv.ParseUint(fields[i+1], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", fields[i+1])
+		}
+		*dst = uint16(n)
+	}
+	return srv, nil
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// Look up the Mauve servers in a domain. Only _mauvealert._udp lookups are
+// answered from the file.
+func (sr *StaticResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if service == "mauvealert" && proto == "udp" {
+		if addrs, ok := sr.services[canonicalName(name)]; ok {
+			ret := make([]*net.SRV, len(addrs))
+			for i, srv := range addrs {
+				cp := *srv
+				ret[i] = &cp
+			}
+			return fmt.Sprintf("_%s._%s.%s.", service, proto, canonicalName(name)), ret, nil
+		}
+	}
+	if sr.Fallback != nil {
+		return sr.Fallback.LookupSRV(ctx, service, proto, name)
+	}
+	return "", nil, fmt.Errorf("No Mauve servers for %s in the static resolver", name)
+}
+
+// Look up the addresses of a host. IP addresses are returned as they are.
+func (sr *StaticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	if addrs, ok := sr.addrs[canonicalName(host)]; ok {
+		return append([]net.IPAddr(nil), addrs...), nil
+	}
+	if sr.Fallback != nil {
+		return sr.Fallback.LookupIPAddr(ctx, host)
+	}
+	return nil, fmt.Errorf("No address for %s in the static resolver", host)
+}
+
+// The resolver to use given an optional static file and an optional DNS
+// server, as taken from the command line: the file is consulted first, then
+// the DNS server, then the system's resolver. Returns nil if neither is set.
+func OpenResolver(staticFile, dnsServer string) (Resolver, error) {
+	var r Resolver
+	if dnsServer != "" {
+		r = NewDNSResolver(dnsServer)
+	}
+	if staticFile != "" {
+		sr, err := LoadStaticResolver(staticFile)
+		if err != nil {
+			return nil, err
+		}
+		sr.Fallback = r
+		if r == nil {
+			sr.Fallback = net.DefaultResolver
+		}
+		r = sr
+	}
+	return r, nil
+}
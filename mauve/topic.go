@@ -0,0 +1,135 @@
+package mauve
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// The versions of the MQTT topic layout. v1 is the one described in
+// README-MQTT.md, and legacy the one govealert used to publish to (with
+// slashes escaped, which it didn't do).
+var TopicTemplates = map[string]string{
+	"v1":     "{base}/{subject}/{source}/{id}",
+	"legacy": "{base}/{source}/{subject}/{id}",
+}
+
+// The topic layout used unless told otherwise.
+const DefaultTopicTemplate = "v1"
+
+// A TopicScheme is how alerts are laid out in MQTT topics, made from a
+// template whose levels are either fixed strings or one of {base},
+// {subject}, {source} and {id}. The base topic is used as it is (and so
+// can be several levels), while the others are escaped with
+// EscapeTopicLevel so each is exactly one level, and can be got back with
+// Parse.
+type TopicScheme struct {
+	Base     string
+	Template string
+	levels   []string // the template's levels with {base} expanded
+}
+
+// Make a scheme from the base topic and either a template or the name of
+// one of the TopicTemplates. Each of {subject}, {source} and {id} must
+// appear once, as a whole level.
+func NewTopicScheme(base, template string) (*TopicScheme, error) {
+	if named, ok := TopicTemplates[template]; ok {
+		template = named
+	}
+	ts := &TopicScheme{Base: base, Template: template}
+	seen := make(map[string]int)
+	for _, level := range strings.Split(template, "/") {
+		if level == "{base}" {
+			ts.levels = append(ts.levels, strings.Split(base, "/")...)
+			continue
+		}
+		if strings.ContainsAny(level, "+#{}") {
+			switch level {
+			case "{subject}", "{source}", "{id}":
+				seen[level]++
+			default:
+				return nil, fmt.Errorf("Bad level %q in topic template %s", level, template)
+			}
+		}
+		ts.levels = append(ts.levels, level)
+	}
+	for _, want := range []string{"{subject}", "{source}", "{id}"} {
+		if seen[want] != 1 {
+			return nil, fmt.Errorf("Topic template %s must have %s exactly once", template, want)
+		}
+	}
+	return ts, nil
+}
+
+// The topic an alert from source is published to.
+func (ts *TopicScheme) Topic(source string, al *Alert) string {
+	parts := make([]string, len(ts.levels))
+	for i, level := range ts.levels {
+		switch level {
+		case "{subject}":
+			parts[i] = EscapeTopicLevel(al.GetSubject())
+		case "{source}":
+			parts[i] = EscapeTopicLevel(source)
+		case "{id}":
+			parts[i] = EscapeTopicLevel(al.GetId())
+		default:
+			parts[i] = level
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// Get the source, subject and alert ID back from a topic.
+func (ts *TopicScheme) Parse(topic string) (source, subject, id string, err error) {
+	parts := strings.Split(topic, "/")
+	if len(parts) != len(ts.levels) {
+		return "", "", "", fmt.Errorf("Topic %s doesn't match %s", topic, ts.Template)
+	}
+	for i, level := range ts.levels {
+		var dst *string
+		switch level {
+		case "{subject}":
+			dst = &subject
+		case "{source}":
+			dst = &source
+		case "{id}":
+			dst = &id
+		default:
+			if parts[i] != level {
+				return "", "", "", fmt.Errorf("Topic %s doesn't match %s", topic, ts.Template)
+			}
+			continue
+		}
+		if *dst, err = UnescapeTopicLevel(parts[i]); err != nil {
+			return "", "", "", fmt.Errorf("Bad escaping in topic %s: %s", topic, err)
+		}
+	}
+	return source, subject, id, nil
+}
+
+// The filter to subscribe to for every alert in the scheme.
+func (ts *TopicScheme) Filter() string {
+	parts := make([]string, len(ts.levels))
+	for i, level := range ts.levels {
+		switch level {
+		case "{subject}", "{source}", "{id}":
+			parts[i] = "+"
+		default:
+			parts[i] = level
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+var topicEscaper = strings.NewReplacer("%", "%25", "/", "%2F", "+", "%2B", "#", "%23")
+
+// Escape a string so that it's a single MQTT topic level without any
+// wildcards, by percent-encoding "/", "+", "#" and "%".
+func EscapeTopicLevel(s string) string {
+	return topicEscaper.Replace(s)
+}
+
+// Undo EscapeTopicLevel.
+func UnescapeTopicLevel(s string) (string, error) {
+	return url.PathUnescape(s)
+}
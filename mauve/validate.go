@@ -0,0 +1,98 @@
+package mauve
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+	"unicode/utf8"
+)
+
+// The longest summary that will fit into a pager or SMS message.
+const MaxSummaryLength = 100
+
+// The reasons an Alert or AlertUpdate can be invalid, which are wrapped in
+// a *ValidationError.
+var (
+	ErrMissingId             = errors.New("id is required")
+	ErrSummaryTooLong        = fmt.Errorf("summary is longer than %d characters", MaxSummaryLength)
+	ErrClearBeforeRaise      = errors.New("clear time is before raise time")
+	ErrMissingSource         = errors.New("source is required")
+	ErrMissingTransmissionId = errors.New("transmission id is required")
+)
+
+// ValidationError says which alert (if any) and which field broke one of
+// the protocol rules.
+type ValidationError struct {
+	AlertId string // empty if the problem is with the AlertUpdate itself
+	Field   string
+	Err     error
+}
+
+func (ve *ValidationError) Error() string {
+	if ve.AlertId != "" {
+		return fmt.Sprintf("Invalid alert %s: %s: %s", ve.AlertId, ve.Field, ve.Err)
+	}
+	return fmt.Sprintf("Invalid alert: %s: %s", ve.Field, ve.Err)
+}
+
+// Check the alert against the rules in mauve.proto, returning a
+// *ValidationError for the first one broken.
+//
+// A clear time before the raise time is only invalid if the raise time has
+// already passed, as a future raise with an earlier clear is how heartbeats
+// (clear now, raise in 10 minutes) work.
+func (m *Alert) Validate() error {
+	if m.GetId() == "" {
+		return &ValidationError{"", "id", ErrMissingId}
+	}
+	if utf8.RuneCountInString(m.GetSummary()) > MaxSummaryLength {
+		return &ValidationError{m.GetId(), "summary", ErrSummaryTooLong}
+	}
+	raise, clear := m.GetRaiseTime(), m.GetClearTime()
+	if clear != 0 && raise != 0 && clear < raise && raise <= uint64(time.Now().Unix()) {
+		return &ValidationError{m.GetId(), "clear_time", ErrClearBeforeRaise}
+	}
+	return nil
+}
+
+// Check the update and every alert in it against the rules in mauve.proto,
+// returning a *ValidationError for the first one broken.
+func (m *AlertUpdate) Validate() error {
+	if m.GetSource() == "" {
+		return &ValidationError{"", "source", ErrMissingSource}
+	}
+	if m.GetTransmissionId() == 0 {
+		return &ValidationError{"", "transmission_id", ErrMissingTransmissionId}
+	}
+	for _, al := range m.Alert {
+		if err := al.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The alerts which are valid by themselves, so that a batch refused in
+// strict mode can be put back without the ones which will never be sent.
+func validAlerts(alerts []*Alert) []*Alert {
+	var valid []*Alert
+	for _, al := range alerts {
+		if al.Validate() == nil {
+			valid = append(valid, al)
+		}
+	}
+	return valid
+}
+
+// Validate an update just before a client sends it. Invalid updates are
+// only refused in strict mode, otherwise they're sent with a warning, as
+// the server may well accept them anyway.
+func validateForSend(up *AlertUpdate, strict bool) error {
+	err := up.Validate()
+	if err != nil && !strict {
+		log.Printf("Sending invalid update anyway: %s", err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,263 @@
+// Package mauvetest provides a stand-in Mauve server, which listens for
+// AlertUpdate packets over UDP and keeps a table of the alerts it has been
+// sent, for use in tests and when developing against the mauve package.
+package mauvetest
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/jiphex/govealert/mauve"
+)
+
+// The most recent state of a single alert, as a real Mauve server would see it.
+type AlertState struct {
+	Source string
+	Alert  *mauve.Alert
+	// When the last update for this alert arrived
+	Updated time.Time
+	// Set when the alert was left out of an update with Replace set
+	Replaced bool
+}
+
+// Whether the alert is raised at the given time. A raise time of zero means
+// the alert is already raised, otherwise whichever of the raise and clear
+// times has most recently passed wins.
+func (as *AlertState) Raised(now time.Time) bool {
+	if as.Replaced {
+		return false
+	}
+	raise, clear := as.Alert.GetRaiseTime(), as.Alert.GetClearTime()
+	t := uint64(now.Unix())
+	raised := raise == 0 || raise <= t
+	cleared := clear != 0 && clear <= t
+	if raised && cleared {
+		return raise > clear
+	}
+	return raised
+}
+
+// Whether notifications for the alert are suppressed at the given time.
+func (as *AlertState) Suppressed(now time.Time) bool {
+	return as.Alert.GetSuppressUntil() > uint64(now.Unix())
+}
+
+type alertKey struct {
+	source string
+	id     string
+}
+
+type Server struct {
+	// If set, updates which aren't signed with this secret are dropped.
+	// It's fixed before the server starts, so nothing slips through unsigned.
+	secret []byte
+
+	conn     *net.UDPConn
+	mu       sync.Mutex // guards everything below
+	alerts   map[alertKey]*AlertState
+	seen     map[uint64]bool
+	updates  int
+	dupes    int
+	rejected int
+}
+
+// Start a server listening on addr, which if empty will be a random port on
+// the loopback interface.
+func NewServer(addr string) (*Server, error) {
+	return NewSignedServer(addr, nil)
+}
+
+// Start a server like NewServer, which drops any update that isn't signed
+// with secret (unless it's nil).
+func NewSignedServer(addr string, secret []byte) (*Server, error) {
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	uaddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", uaddr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		secret: secret,
+		conn:   conn,
+		alerts: make(map[alertKey]*AlertState),
+		seen:   make(map[uint64]bool),
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *Server) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			// almost certainly because we've been closed
+			return
+		}
+		up := new(mauve.AlertUpdate)
+		if err := proto.Unmarshal(buf[:n], up); err != nil {
+			log.Printf("Bad packet from %s: %s", from, err)
+			s.mu.Lock()
+			s.rejected++
+			s.mu.Unlock()
+			continue
+		}
+		if err := s.Apply(up); err != nil {
+			log.Printf("Rejected update from %s: %s", from, err)
+		}
+	}
+}
+
+// Apply an AlertUpdate to the alert table, as if it had arrived over the
+// network. Updates with a TransmissionId that's already been seen are
+// ignored.
+func (s *Server) Apply(up *mauve.AlertUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.secret != nil {
+		if err := mauve.VerifyUpdate(up, s.secret); err != nil {
+			s.rejected++
+			return err
+		}
+	}
+	if s.seen[up.GetTransmissionId()] {
+		s.dupes++
+		return nil
+	}
+	s.seen[up.GetTransmissionId()] = true
+	s.updates++
+	now := time.Now()
+	source := up.GetSource()
+	listed := make(map[string]bool)
+	for _, al := range up.Alert {
+		listed[al.GetId()] = true
+		s.alerts[alertKey{source, al.GetId()}] = &AlertState{
+			Source:  source,
+			Alert:   al,
+			Updated: now,
+		}
+	}
+	if up.GetReplace() {
+		for k, as := range s.alerts {
+			if k.source == source && !listed[k.id] {
+				as.Replaced = true
+				as.Updated = now
+			}
+		}
+	}
+	return nil
+}
+
+// The address the server is listening on.
+func (s *Server) Addr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// The server as a MauveAlertService, for use in a ProtobufClient's Hosts.
+func (s *Server) Service() *mauve.MauveAlertService {
+	addr := s.Addr()
+	return &mauve.MauveAlertService{Host: addr.IP.String(), Port: uint16(addr.Port)}
+}
+
+func (s *Server) Close() error {
+	return s.conn.Close()
+}
+
+// Every alert the server knows about, ordered by source and then ID. These
+// are copies, so they don't change as more updates arrive.
+func (s *Server) Alerts() []*AlertState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]*AlertState, 0, len(s.alerts))
+	for _, as := range s.alerts {
+		cp := *as
+		ret = append(ret, &cp)
+	}
+	sort.Sort(bySourceAndId(ret))
+	return ret
+}
+
+// A copy of the alert with the given source and ID, or nil if it's never
+// been sent.
+func (s *Server) Alert(source string, id string) *AlertState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	as, ok := s.alerts[alertKey{source, id}]
+	if !ok {
+		return nil
+	}
+	cp := *as
+	return &cp
+}
+
+// The number of updates accepted, not counting duplicates.
+func (s *Server) Updates() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.updates
+}
+
+// The number of duplicate updates which were ignored.
+func (s *Server) Duplicates() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dupes
+}
+
+// The number of packets which couldn't be decoded or failed verification.
+func (s *Server) Rejected() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rejected
+}
+
+// Wait until at least n updates have been accepted, as UDP gives no other
+// way of knowing when something sent has arrived.
+func (s *Server) WaitForUpdates(n int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for s.Updates() < n {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Only got %d of %d updates after %s", s.Updates(), n, timeout)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return nil
+}
+
+// Write out the alert table as text, one alert per line, from a copy of it
+// taken under the lock.
+func (s *Server) Dump(w io.Writer) {
+	now := time.Now()
+	for _, as := range s.Alerts() {
+		state := "cleared"
+		if as.Raised(now) {
+			state = "RAISED"
+		}
+		if as.Suppressed(now) {
+			state += " (suppressed)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", as.Source, as.Alert.GetId(), as.Alert.GetSubject(), state, as.Alert.GetSummary())
+	}
+}
+
+type bySourceAndId []*AlertState
+
+func (a bySourceAndId) Len() int      { return len(a) }
+func (a bySourceAndId) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a bySourceAndId) Less(i, j int) bool {
+	if a[i].Source != a[j].Source {
+		return a[i].Source < a[j].Source
+	}
+	return a[i].Alert.GetId() < a[j].Alert.GetId()
+}
@@ -0,0 +1,271 @@
+package mauvetest
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/jiphex/govealert/mauve"
+)
+
+func testClient(srv *Server, source string) *mauve.ProtobufClient {
+	return &mauve.ProtobufClient{
+		Hosts:  []*mauve.MauveAlertService{srv.Service()},
+		Source: source,
+	}
+}
+
+func mustAlert(t *testing.T, id string, raise string, clear string) *mauve.Alert {
+	al, err := mauve.CreateAlert(id, raise, clear, "subject.example.com", "summary", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create alert: %s", err)
+	}
+	return al
+}
+
+func TestSendBatchedAlerts(t *testing.T) {
+	srv, err := NewServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	pbc := testClient(srv, "test.example.com")
+	pbc.AddBatchedAlert(mustAlert(t, "one", "now", ""))
+	pbc.AddBatchedAlert(mustAlert(t, "two", "now", ""))
+	if err := pbc.SendBatchedAlerts(false); err != nil {
+		t.Fatalf("Failed to send: %s", err)
+	}
+	if err := srv.WaitForUpdates(1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.Alerts()); n != 2 {
+		t.Errorf("Expected 2 alerts, server has %d", n)
+	}
+	if as := srv.Alert("test.example.com", "one"); as == nil || !as.Raised(time.Now()) {
+		t.Errorf("Alert one should be raised, got %v", as)
+	}
+	// The batch should have been emptied by the first send
+	pbc.AddBatchedAlert(mustAlert(t, "one", "", "now"))
+	if err := pbc.SendBatchedAlerts(false); err != nil {
+		t.Fatalf("Failed to send: %s", err)
+	}
+	if err := srv.WaitForUpdates(2, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if as := srv.Alert("test.example.com", "one"); as.Raised(time.Now()) {
+		t.Errorf("Alert one should have been cleared")
+	}
+	if as := srv.Alert("test.example.com", "two"); !as.Raised(time.Now()) {
+		t.Errorf("Alert two shouldn't have been touched by the second send")
+	}
+	// Nothing's batched, so nothing should be sent
+	if err := pbc.Flush(context.Background()); err != nil {
+		t.Fatalf("Failed to flush: %s", err)
+	}
+	if err := srv.WaitForUpdates(3, 100*time.Millisecond); err == nil {
+		t.Errorf("An empty batch shouldn't be sent")
+	}
+	// Apart from an empty replace, which clears everything
+	if err := pbc.SendBatchedAlerts(true); err != nil {
+		t.Fatalf("Failed to send: %s", err)
+	}
+	if err := srv.WaitForUpdates(3, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if as := srv.Alert("test.example.com", "two"); as.Raised(time.Now()) {
+		t.Errorf("Alert two should have been cleared by an empty replace")
+	}
+}
+
+func TestReplace(t *testing.T) {
+	srv, err := NewServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Apply(mauve.CreateUpdate("a", false, mustAlert(t, "one", "now", ""), mustAlert(t, "two", "now", "")))
+	srv.Apply(mauve.CreateUpdate("b", false, mustAlert(t, "one", "now", "")))
+	srv.Apply(mauve.CreateUpdate("a", true, mustAlert(t, "two", "now", "")))
+	now := time.Now()
+	if srv.Alert("a", "one").Raised(now) {
+		t.Errorf("a/one should have been replaced away")
+	}
+	if !srv.Alert("a", "two").Raised(now) {
+		t.Errorf("a/two was in the replacing update so should still be raised")
+	}
+	if !srv.Alert("b", "one").Raised(now) {
+		t.Errorf("Replace for source a shouldn't affect source b")
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	srv, err := NewServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	pkt, err := proto.Marshal(mauve.CreateUpdate("test.example.com", false, mustAlert(t, "one", "now", "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialUDP("udp", nil, srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(pkt)
+	conn.Write(pkt)
+	if err := srv.WaitForUpdates(1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for srv.Duplicates() < 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if srv.Updates() != 1 || srv.Duplicates() != 1 {
+		t.Errorf("Expected 1 update and 1 duplicate, got %d and %d", srv.Updates(), srv.Duplicates())
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	srv, err := NewServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	// The same alert govealert sends in heartbeat mode
+	srv.Apply(mauve.CreateUpdate("test.example.com", false, mustAlert(t, "heartbeat", "+10m", "now")))
+	as := srv.Alert("test.example.com", "heartbeat")
+	if as.Raised(time.Now()) {
+		t.Errorf("Heartbeat should be cleared until the raise time")
+	}
+	if !as.Raised(time.Now().Add(11 * time.Minute)) {
+		t.Errorf("Heartbeat should be raised if not refreshed within 10 minutes")
+	}
+}
+
+func TestSignedUpdates(t *testing.T) {
+	secret := []byte("sekrit")
+	srv, err := NewSignedServer("", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	if err := srv.Apply(mauve.CreateUpdate("test.example.com", false, mustAlert(t, "one", "now", ""))); err != mauve.ErrNoSignature {
+		t.Errorf("Unsigned update should have been rejected, got %v", err)
+	}
+	pbc := testClient(srv, "test.example.com")
+	pbc.Secret = secret
+	pbc.AddBatchedAlert(mustAlert(t, "one", "now", ""))
+	if err := pbc.SendBatchedAlerts(false); err != nil {
+		t.Fatalf("Failed to send: %s", err)
+	}
+	if err := srv.WaitForUpdates(1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStrictClient(t *testing.T) {
+	srv, err := NewServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	pbc := testClient(srv, "test.example.com")
+	pbc.Strict = true
+	pbc.AddBatchedAlert(mauve.NewAlert("", mauve.RaiseAfter(0)))
+	if err := pbc.SendBatchedAlerts(false); err == nil {
+		t.Errorf("Strict client sent an alert with no id")
+	}
+	if srv.Updates() != 0 {
+		t.Errorf("Server got an update from a strict client")
+	}
+}
+
+func TestRepeat(t *testing.T) {
+	srv, err := NewServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	pbc := testClient(srv, "test.example.com")
+	mauve.WithRepeat(3, 10*time.Millisecond)(pbc)
+	pbc.AddBatchedAlert(mustAlert(t, "one", "now", ""))
+	if err := pbc.SendBatchedAlerts(false); err != nil {
+		t.Fatalf("Failed to send: %s", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for srv.Duplicates() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if srv.Updates() != 1 || srv.Duplicates() != 2 {
+		t.Errorf("Expected 1 update and 2 duplicates, got %d and %d", srv.Updates(), srv.Duplicates())
+	}
+}
+
+func TestAlertCopies(t *testing.T) {
+	srv, err := NewServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Apply(mauve.CreateUpdate("test.example.com", false, mustAlert(t, "one", "now", "")))
+	before := srv.Alert("test.example.com", "one")
+	all := srv.Alerts()
+	// Dumped while updates are still arriving, as govealert-fakeserver does
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			srv.Dump(ioutil.Discard)
+		}
+	}()
+	srv.Apply(mauve.CreateUpdate("test.example.com", true, mustAlert(t, "two", "now", "")))
+	<-done
+	if before.Replaced || all[0].Replaced {
+		t.Errorf("Alerts handed out shouldn't change with later updates")
+	}
+	if !srv.Alert("test.example.com", "one").Replaced {
+		t.Errorf("Alert should have been replaced")
+	}
+}
+
+func TestPartialDelivery(t *testing.T) {
+	srv, err := NewServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	// Nothing's in the static resolver, so the first host can't be looked up
+	resolver, err := mauve.ParseStaticResolver(strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unresolvable := &mauve.MauveAlertService{Host: "mauve.example.invalid", Port: 32741}
+	pbc := testClient(srv, "test.example.com")
+	pbc.Hosts = append([]*mauve.MauveAlertService{unresolvable}, pbc.Hosts...)
+	pbc.Resolver = resolver
+	err = pbc.Send(context.Background(), mauve.CreateUpdate("test.example.com", false, mustAlert(t, "one", "now", "")))
+	se, ok := err.(*mauve.SendError)
+	if !ok {
+		t.Fatalf("Expected a *SendError, got %v", err)
+	}
+	if se.Delivered != 1 || len(se.Failed) != 1 {
+		t.Fatalf("Expected 1 host delivered to and 1 failed, got %s", se)
+	}
+	if se.Failed[0].Host != unresolvable || se.Failed[0].Stage != mauve.StageResolve {
+		t.Errorf("Expected the unresolvable host to fail at resolving, got %s", se.Failed[0])
+	}
+	if err := srv.WaitForUpdates(1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// With no hosts at all it's an error, not delivered to all of none
+	pbc.Hosts = nil
+	if err := pbc.Send(context.Background(), mauve.CreateUpdate("test.example.com", false, mustAlert(t, "one", "now", ""))); err != mauve.ErrNoHosts {
+		t.Errorf("Expected ErrNoHosts, got %v", err)
+	}
+}